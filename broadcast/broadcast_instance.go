@@ -2,66 +2,166 @@ package broadcast
 
 import (
 	"context"
+	"log"
 	"reflect"
+	"sync"
 )
 
 type broadcasterInstance struct {
-	listenc       chan chan (chan message)
-	listenerStubs *chanStubList
-	Sendc         chan<- payload
+	mu        sync.RWMutex
+	sendMu    sync.Mutex
+	listeners []*listener
+	stopped   bool
+	// last messages replayed to new listeners, guarded by sendMu
+	replay     []message
+	replaySize int
+	obs        *observer
+	durable    *durableLog
 }
 
-func newInstance() *broadcasterInstance {
-	listenc := make(chan (chan (chan message)))
-	sendc := make(chan payload)
-	go runNotifierSafe(sendc, listenc)
-	return &broadcasterInstance{
-		listenc:       listenc,
-		Sendc:         sendc,
-		listenerStubs: newChanStubList(),
-	}
+func newInstance(replaySize int, obs *observer, durable *durableLog) *broadcasterInstance {
+	return &broadcasterInstance{replaySize: replaySize, obs: obs, durable: durable}
 }
 
-func (b *broadcasterInstance) AddListener(fn reflect.Value) ListenerStub {
-	c := make(chan chan message)
-	b.listenc <- c
-	rc := <-c
-	stub := newChanStub()
-	b.listenerStubs.Append(stub)
-	go runListenerSafe(rc, stub, fn)
-	return stub
+func (b *broadcasterInstance) AddListener(fn reflect.Value, opt *listenerOptions) ListenerStub {
+	l := newListener(fn, opt, b.obs)
+	l.stub.unsubscribe = func() { b.removeListener(l) }
+	if opt.DurableName != "" && b.durable != nil {
+		l.durable = &durableConsumer{log: b.durable, name: opt.DurableName}
+		onDrop := l.mb.onDrop
+		l.mb.onDrop = func(msg message) {
+			l.durable.Drop(msg)
+			if onDrop != nil {
+				onDrop(msg)
+			}
+		}
+	}
+	go runListenerSafe(l)
+	if b.replaySize > 0 || l.durable != nil {
+		/* no message can be sent between replay and attaching */
+		b.sendMu.Lock()
+		defer b.sendMu.Unlock()
+		if err := b.replayTo(l, fn.Type().In(1)); err != nil {
+			if err != ErrMessageDropped {
+				log.Printf("broadcast: redeliver %s to %s: %v", b.durable.topic, opt.DurableName, err)
+			}
+			l.mb.Close(true)
+			return l.stub
+		}
+	}
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		l.mb.Close(true)
+	} else {
+		b.listeners = append(b.listeners, l)
+		b.mu.Unlock()
+	}
+	return l.stub
 }
 
 func (b *broadcasterInstance) Send(ctx context.Context, v interface{}) {
-	b.Sendc <- newPayload(ctx, v)
+	/* keep the same order for all listeners */
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	msg := b.newMessage(ctx, v)
+	b.record(msg)
+	b.dispatch(context.Background(), b.getListeners(), msg)
+}
+
+// Publish dispatch v to all listeners, the returned collector is done once they processed v.
+// Blocking on full backlog stops when ctx is done, remaining listeners do not get v then
+func (b *broadcasterInstance) Publish(ctx context.Context, v interface{}) *ackCollector {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	listeners := b.getListeners()
+	collector := newAckCollector(len(listeners))
+	msg := b.newMessage(ctx, v)
+	msg.Ack = collector.Ack
+	b.record(msg)
+	b.dispatch(ctx, listeners, msg)
+	return collector
+}
+
+// newMessage must be called with sendMu held, so that offsets are dispatched in order
+func (b *broadcasterInstance) newMessage(ctx context.Context, v interface{}) message {
+	msg := message{Payload: newPayload(ctx, v)}
+	if b.durable != nil {
+		offset, err := b.durable.Append(v)
+		if err != nil {
+			log.Printf("broadcast: append %s: %v", b.durable.topic, err)
+		}
+		msg.Offset = offset
+	}
+	return msg
+}
+
+// replayTo put history messages into new listener, durable listeners get unacknowledged events instead of replay
+func (b *broadcasterInstance) replayTo(l *listener, typ reflect.Type) error {
+	if l.durable != nil {
+		return b.durable.Redeliver(l, typ)
+	}
+	for _, msg := range b.replay {
+		if l.mb.Put(msg) == putDetach {
+			return ErrMessageDropped
+		}
+	}
+	return nil
+}
+
+func (b *broadcasterInstance) record(msg message) {
+	if b.replaySize <= 0 {
+		return
+	}
+	/* replayed messages are never acked */
+	msg.Ack = nil
+	if len(b.replay) >= b.replaySize {
+		copy(b.replay, b.replay[1:])
+		b.replay = b.replay[:len(b.replay)-1]
+	}
+	b.replay = append(b.replay, msg)
+}
+
+func (b *broadcasterInstance) dispatch(ctx context.Context, listeners []*listener, msg message) {
+	for _, l := range listeners {
+		switch l.mb.PutContext(ctx, msg) {
+		case putDetach:
+			b.removeListener(l)
+		case putCancelled:
+			return
+		}
+	}
 }
 
 func (b *broadcasterInstance) Stop() {
-	close(b.Sendc)
-	b.listenerStubs.Wait()
+	b.mu.Lock()
+	listeners := b.listeners
+	b.listeners = nil
+	b.stopped = true
+	b.mu.Unlock()
+	for _, l := range listeners {
+		l.mb.Close(false)
+	}
+	for _, l := range listeners {
+		l.stub.Wait()
+	}
 }
 
-func runNotifierSafe(sendc chan payload, listenc chan chan chan message) {
-	allowPanic("broadcast.notifier", func() {
-		runNotifierLoop(sendc, listenc)
-	})
+func (b *broadcasterInstance) getListeners() []*listener {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.listeners
 }
 
-func runNotifierLoop(sendc chan payload, listenc chan chan chan message) {
-	currc := make(chan message, 1)
-	for {
-		select {
-		case v, ok := <-sendc:
-			if !ok {
-				currc <- terminationMsg
-				return
-			}
-			c := make(chan message, 1)
-			b := message{Next: c, Payload: v}
-			currc <- b
-			currc = c
-		case r := <-listenc:
-			r <- currc
+func (b *broadcasterInstance) removeListener(l *listener) {
+	b.mu.Lock()
+	var list []*listener
+	for _, item := range b.listeners {
+		if item != l {
+			list = append(list, item)
 		}
 	}
+	b.listeners = list
+	b.mu.Unlock()
+	l.mb.Close(true)
 }
@@ -2,10 +2,17 @@ package broadcast
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/qjpcpu/common.v2/cli"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -101,3 +108,671 @@ func TestBroadcastStop(t *testing.T) {
 	default:
 	}
 }
+
+func TestBroadcastBacklogDropOldest(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	block := make(chan struct{})
+	var got []int
+	ch := make(chan int, 10)
+	l := b.AddListener(func(ctx context.Context, args int) {
+		<-block
+		ch <- args
+	}, WithMaxBacklog(2, DropOldest))
+	ctx := context.Background()
+	b.Notify(ctx, 1)
+	for l.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Notify(ctx, 2)
+	b.Notify(ctx, 3)
+	b.Notify(ctx, 4)
+	assert.Equal(2, l.Lag())
+	close(block)
+	b.Stop()
+	l.Wait()
+	close(ch)
+	for v := range ch {
+		got = append(got, v)
+	}
+	assert.Equal([]int{1, 3, 4}, got)
+}
+
+func TestBroadcastBacklogDropNewest(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	block := make(chan struct{})
+	var got []int
+	ch := make(chan int, 10)
+	l := b.AddListener(func(ctx context.Context, args int) {
+		<-block
+		ch <- args
+	}, WithMaxBacklog(2, DropNewest))
+	ctx := context.Background()
+	b.Notify(ctx, 1)
+	for l.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Notify(ctx, 2)
+	b.Notify(ctx, 3)
+	b.Notify(ctx, 4)
+	close(block)
+	b.Stop()
+	l.Wait()
+	close(ch)
+	for v := range ch {
+		got = append(got, v)
+	}
+	assert.Equal([]int{1, 2, 3}, got)
+}
+
+func TestBroadcastBacklogBlockSender(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	block := make(chan struct{})
+	l := b.AddListener(func(ctx context.Context, args int) {
+		<-block
+	}, WithMaxBacklog(1, BlockSender))
+	ctx := context.Background()
+	b.Notify(ctx, 1)
+	for l.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Notify(ctx, 2)
+	done := make(chan struct{})
+	go func() {
+		b.Notify(ctx, 3)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("sender should be blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(block)
+	<-done
+	b.Stop()
+	l.Wait()
+	assert.Equal(0, l.Lag())
+}
+
+func TestBroadcastBacklogBlockSenderPublishCancel(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	block := make(chan struct{})
+	var got []int
+	l := b.AddListener(func(ctx context.Context, args int) {
+		<-block
+		got = append(got, args)
+	}, WithMaxBacklog(1, BlockSender))
+	b.Notify(context.Background(), 1)
+	for l.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Notify(context.Background(), 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(context.DeadlineExceeded, b.Publish(ctx, 3))
+	assert.True(time.Since(start) < 200*time.Millisecond)
+
+	/* other senders are not stalled, cancelled message is not enqueued */
+	close(block)
+	assert.NoError(b.Publish(context.Background(), 4))
+	b.Stop()
+	l.Wait()
+	assert.Equal([]int{1, 2, 4}, got)
+}
+
+func TestBroadcastBacklogAutoUnsubscribe(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	block := make(chan struct{})
+	var count int32
+	slow := b.AddListener(func(ctx context.Context, args int) {
+		<-block
+	}, WithMaxBacklog(1, AutoUnsubscribe))
+	fast := b.AddListener(func(ctx context.Context, args int) {
+		atomic.AddInt32(&count, 1)
+	})
+	ctx := context.Background()
+	b.Notify(ctx, 1)
+	for slow.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Notify(ctx, 2)
+	b.Notify(ctx, 3)
+	close(block)
+	slow.Wait()
+	assert.Equal(0, slow.Lag())
+	b.Notify(ctx, 4)
+	b.Stop()
+	fast.Wait()
+	assert.Equal(int32(4), atomic.LoadInt32(&count))
+}
+
+func TestBroadcastUnsubscribe(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	var count1, count2 int32
+	l1 := b.AddListener(func(ctx context.Context, args int) {
+		atomic.AddInt32(&count1, 1)
+	})
+	l2 := b.AddListener(func(ctx context.Context, args int) {
+		atomic.AddInt32(&count2, 1)
+	})
+	ctx := context.Background()
+	b.Notify(ctx, 1)
+	for l1.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	l1.Unsubscribe()
+	l1.Wait()
+	b.Notify(ctx, 2)
+	b.Stop()
+	l2.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&count1))
+	assert.Equal(int32(2), atomic.LoadInt32(&count2))
+}
+
+func TestBroadcastListenerContext(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	var count int32
+	ctx, cancel := context.WithCancel(context.Background())
+	l := b.AddListenerContext(ctx, func(ctx context.Context, args int) {
+		atomic.AddInt32(&count, 1)
+	})
+	b.Notify(context.Background(), 1)
+	for l.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	l.Wait()
+	b.Notify(context.Background(), 2)
+	b.Stop()
+	assert.Equal(int32(1), atomic.LoadInt32(&count))
+}
+
+func TestBroadcastPublish(t *testing.T) {
+	logStack = func(tag string, r interface{}) {}
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	var count int32
+	b.AddListener(func(ctx context.Context, args int) {
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&count, 1)
+	})
+	b.AddListener(func(ctx context.Context, args int) error {
+		if args == 2 {
+			return errors.New("bad value")
+		}
+		return nil
+	})
+	b.AddListener(func(ctx context.Context, args int) error {
+		if args == 2 {
+			panic("oops")
+		}
+		return nil
+	})
+	ctx := context.Background()
+	assert.NoError(b.Publish(ctx, 1))
+	assert.Equal(int32(1), atomic.LoadInt32(&count))
+
+	err := b.Publish(ctx, 2)
+	assert.Error(err)
+	merr, ok := err.(MultiError)
+	assert.True(ok)
+	assert.Len(merr, 2)
+	assert.Contains(err.Error(), "bad value")
+	var perr *PanicError
+	for _, e := range merr {
+		if pe, ok := e.(*PanicError); ok {
+			perr = pe
+		}
+	}
+	assert.NotNil(perr)
+	assert.Equal("oops", perr.Value)
+	assert.Equal(int32(2), atomic.LoadInt32(&count))
+
+	assert.NoError(b.Publish(ctx, "no listener"))
+}
+
+func TestBroadcastListenerSignature(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	var count int32
+	b.AddListener(func(ctx context.Context, args int) bool {
+		atomic.AddInt32(&count, 1)
+		return true
+	})
+	assert.NoError(b.Publish(context.Background(), 1))
+	assert.Equal(int32(1), atomic.LoadInt32(&count))
+
+	assert.Panics(func() { b.AddListener(func(args int) {}) })
+	assert.Panics(func() { b.AddListener("not a function") })
+	assert.Panics(func() { NewTopicBroadcaster().AddListener("a.*", func(ctx context.Context) {}) })
+	b.Stop()
+}
+
+func TestBroadcastPublishCancel(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	block := make(chan struct{})
+	b.AddListener(func(ctx context.Context, args int) {
+		<-block
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, b.Publish(ctx, 1))
+	close(block)
+	b.Stop()
+}
+
+type stringerEvent struct{ Name string }
+
+func (s stringerEvent) String() string { return s.Name }
+
+func TestBroadcastInterfaceListener(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	var exact, stringer, any int32
+	b.AddListener(func(ctx context.Context, s stringerEvent) {
+		atomic.AddInt32(&exact, 1)
+	})
+	b.AddListener(func(ctx context.Context, s fmt.Stringer) {
+		atomic.AddInt32(&stringer, 1)
+	})
+	b.AddListener(func(ctx context.Context, v interface{}) {
+		atomic.AddInt32(&any, 1)
+	})
+	ctx := context.Background()
+	assert.NoError(b.Publish(ctx, stringerEvent{Name: "A"}))
+	assert.NoError(b.Publish(ctx, 1))
+	assert.NoError(b.Publish(ctx, TypedString("B")))
+	assert.Equal(int32(1), atomic.LoadInt32(&exact))
+	assert.Equal(int32(1), atomic.LoadInt32(&stringer))
+	assert.Equal(int32(3), atomic.LoadInt32(&any))
+	b.Stop()
+}
+
+func TestMatchTopic(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(MatchTopic("order.*.created", "order.42.created"))
+	assert.False(MatchTopic("order.*.created", "order.42.paid"))
+	assert.False(MatchTopic("order.*.created", "order.created"))
+	assert.True(MatchTopic("order.#", "order"))
+	assert.True(MatchTopic("order.#", "order.42.created"))
+	assert.True(MatchTopic("#.created", "order.42.created"))
+	assert.True(MatchTopic("order.#.created", "order.created"))
+	assert.True(MatchTopic("ord*.42", "order.42"))
+	assert.False(MatchTopic("order", "order.42"))
+}
+
+func TestTopicBroadcast(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTopicBroadcaster()
+	var created, all, str int32
+	topics := make(chan string, 10)
+	b.AddListener("order.*.created", func(ctx context.Context, id int) {
+		topics <- TopicFromContext(ctx)
+		atomic.AddInt32(&created, 1)
+	})
+	b.AddListener("order.#", func(ctx context.Context, v interface{}) {
+		atomic.AddInt32(&all, 1)
+	})
+	b.AddListener("order.#", func(ctx context.Context, v string) {
+		atomic.AddInt32(&str, 1)
+	})
+	ctx := context.Background()
+	assert.NoError(b.Publish(ctx, "order.42.created", 42))
+	assert.NoError(b.Publish(ctx, "order.42.paid", 42))
+	assert.NoError(b.Publish(ctx, "order.43.created", "43"))
+	assert.NoError(b.Publish(ctx, "user.1.created", 1))
+	assert.Equal(int32(1), atomic.LoadInt32(&created))
+	assert.Equal(int32(3), atomic.LoadInt32(&all))
+	assert.Equal(int32(1), atomic.LoadInt32(&str))
+	assert.Equal("order.42.created", <-topics)
+	b.Stop()
+}
+
+func TestBroadcastReplay(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster(WithReplay(2))
+	ctx := context.Background()
+	b.Notify(ctx, 1)
+	b.Notify(ctx, 2)
+	b.Notify(ctx, 3)
+	ch := make(chan int, 10)
+	l := b.AddListener(func(ctx context.Context, args int) {
+		ch <- args
+	})
+	b.Notify(ctx, 4)
+	b.Stop()
+	l.Wait()
+	close(ch)
+	var got []int
+	for v := range ch {
+		got = append(got, v)
+	}
+	assert.Equal([]int{2, 3, 4}, got)
+}
+
+func TestBroadcastDurableDropped(t *testing.T) {
+	assert := assert.New(t)
+	type Job struct {
+		ID int
+	}
+	dir, err := ioutil.TempDir("", "broadcast")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := cli.NewFileDB(dir)
+	assert.NoError(err)
+	defer db.Close()
+	ctx := context.Background()
+
+	/* job 3 is dropped while job 1 is processing and job 2 is queued, so job 4 must not be acknowledged */
+	b := NewTypedBroadcaster(WithEventStore(NewFileDBStore(db, "events")))
+	started, block := make(chan struct{}), make(chan struct{})
+	b.AddListener(func(ctx context.Context, job *Job) {
+		if job.ID == 1 {
+			close(started)
+			<-block
+		}
+	}, WithDurableName("worker"), WithMaxBacklog(1, DropNewest))
+	b.Notify(ctx, &Job{ID: 1})
+	<-started
+	b.Notify(ctx, &Job{ID: 2})
+	b.Notify(ctx, &Job{ID: 3})
+	close(block)
+	b.Notify(ctx, &Job{ID: 4})
+	b.Stop()
+
+	b = NewTypedBroadcaster(WithEventStore(NewFileDBStore(db, "events")))
+	ch := make(chan int, 10)
+	b.AddListener(func(ctx context.Context, job *Job) {
+		ch <- job.ID
+	}, WithDurableName("worker"))
+	b.Stop()
+	close(ch)
+	var got []int
+	for id := range ch {
+		got = append(got, id)
+	}
+	assert.Equal([]int{3, 4}, got)
+}
+
+func TestBroadcastSticky(t *testing.T) {
+	assert := assert.New(t)
+	type Config struct {
+		Version int
+	}
+	b := NewTypedBroadcaster(WithSticky(&Config{}))
+	ctx := context.Background()
+	b.Notify(ctx, &Config{Version: 1})
+	b.Notify(ctx, &Config{Version: 2})
+	b.Notify(ctx, 1)
+	ch := make(chan int, 10)
+	l1 := b.AddListener(func(ctx context.Context, c *Config) {
+		ch <- c.Version
+	})
+	l2 := b.AddListener(func(ctx context.Context, args int) {
+		ch <- args
+	})
+	b.Stop()
+	l1.Wait()
+	l2.Wait()
+	close(ch)
+	var got []int
+	for v := range ch {
+		got = append(got, v)
+	}
+	assert.Equal([]int{2}, got)
+}
+
+func TestBroadcastWorkers(t *testing.T) {
+	assert := assert.New(t)
+	b := NewTypedBroadcaster()
+	var running, maxRunning int32
+	b.AddListener(func(ctx context.Context, args int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}, WithWorkers(4))
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		b.Notify(ctx, i)
+	}
+	b.Stop()
+	assert.True(atomic.LoadInt32(&maxRunning) > 1)
+}
+
+func TestBroadcastKeyAffinity(t *testing.T) {
+	assert := assert.New(t)
+	type Event struct {
+		Key string
+		Seq int
+	}
+	b := NewTypedBroadcaster()
+	ch := make(chan *Event, 100)
+	l := b.AddListener(func(ctx context.Context, e *Event) {
+		time.Sleep(time.Duration(e.Seq%3) * time.Millisecond)
+		ch <- e
+	}, WithKeyAffinity(4, func(e *Event) string { return e.Key }))
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		b.Notify(ctx, &Event{Key: fmt.Sprint(i % 5), Seq: i})
+	}
+	b.Stop()
+	l.Wait()
+	close(ch)
+	last := make(map[string]int)
+	var count int
+	for e := range ch {
+		count++
+		if seq, ok := last[e.Key]; ok {
+			assert.True(seq < e.Seq)
+		}
+		last[e.Key] = e.Seq
+	}
+	assert.Equal(30, count)
+}
+
+func TestBroadcastHooksAndStats(t *testing.T) {
+	assert := assert.New(t)
+	panics := make(chan PanicInfo, 10)
+	var delivered, dropped int32
+	b := NewTypedBroadcaster(
+		WithPanicHook(func(info PanicInfo) { panics <- info }),
+		WithDeliveredHook(func(typ reflect.Type, cost time.Duration, err error) {
+			atomic.AddInt32(&delivered, 1)
+		}),
+		WithDroppedHook(func(typ reflect.Type) {
+			atomic.AddInt32(&dropped, 1)
+		}),
+	)
+	block := make(chan struct{})
+	l := b.AddListener(func(ctx context.Context, args int) {
+		<-block
+		if args == 0 {
+			panic("zero")
+		}
+	}, WithMaxBacklog(1, DropNewest))
+	ctx := context.Background()
+	b.Notify(ctx, 0)
+	for l.Lag() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Notify(ctx, 1)
+	b.Notify(ctx, 2)
+	close(block)
+	b.Stop()
+
+	info := <-panics
+	assert.Equal("zero", info.Value)
+	assert.Equal(reflect.TypeOf(0), info.PayloadType)
+	assert.NotEmpty(info.Stack)
+	assert.Equal(int32(2), atomic.LoadInt32(&delivered))
+	assert.Equal(int32(1), atomic.LoadInt32(&dropped))
+
+	stats := b.Stats().Events["int"]
+	assert.Equal(uint64(2), stats.Delivered)
+	assert.Equal(uint64(1), stats.Failed)
+	assert.Equal(uint64(1), stats.Panics)
+	assert.Equal(uint64(1), stats.Dropped)
+	var count uint64
+	for _, c := range stats.Latency.Counts {
+		count += c
+	}
+	assert.Equal(uint64(2), count)
+}
+
+func TestBroadcastDurable(t *testing.T) {
+	assert := assert.New(t)
+	type Job struct {
+		ID int
+	}
+	dir, err := ioutil.TempDir("", "broadcast")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := cli.NewFileDB(dir)
+	assert.NoError(err)
+	store := NewFileDBStore(db, "events")
+	ctx := context.Background()
+
+	/* first run: job 2 fails, so 2 and 3 are not acknowledged */
+	b := NewTypedBroadcaster(WithEventStore(store))
+	b.Notify(ctx, &Job{ID: 1})
+	ch := make(chan int, 10)
+	b.AddListener(func(ctx context.Context, job *Job) error {
+		ch <- job.ID
+		if job.ID == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	}, WithDurableName("worker"))
+	b.Notify(ctx, &Job{ID: 2})
+	b.Notify(ctx, &Job{ID: 3})
+	b.Stop()
+	assert.Equal(1, <-ch)
+	assert.Equal(2, <-ch)
+	assert.Equal(3, <-ch)
+
+	/* restart */
+	db.Close()
+	db, err = cli.NewFileDB(dir)
+	assert.NoError(err)
+	defer db.Close()
+	b = NewTypedBroadcaster(WithEventStore(NewFileDBStore(db, "events")))
+	b.AddListener(func(ctx context.Context, job *Job) {
+		ch <- job.ID
+	}, WithDurableName("worker"))
+	b.Notify(ctx, &Job{ID: 4})
+	b.Stop()
+	close(ch)
+	var got []int
+	for id := range ch {
+		got = append(got, id)
+	}
+	assert.Equal([]int{2, 3, 4}, got)
+}
+
+func TestFileDBStoreConcurrentAppend(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "broadcast")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := cli.NewFileDB(dir)
+	assert.NoError(err)
+	defer db.Close()
+
+	/* two stores on one bucket, like two broadcasters */
+	stores := []EventStore{NewFileDBStore(db, "ev"), NewFileDBStore(db, "ev")}
+	var mu sync.Mutex
+	offsets := make(map[uint64]bool)
+	wg := new(sync.WaitGroup)
+	for i, store := range stores {
+		wg.Add(1)
+		go func(i int, store EventStore) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				offset, err := store.Append("topic", []byte(fmt.Sprintf(`"%d-%d"`, i, j)))
+				assert.NoError(err)
+				mu.Lock()
+				assert.False(offsets[offset], "duplicated offset %d", offset)
+				offsets[offset] = true
+				mu.Unlock()
+			}
+		}(i, store)
+	}
+	wg.Wait()
+	events := make(map[string]bool)
+	assert.NoError(stores[0].ReadFrom("topic", 0, func(offset uint64, data []byte) error {
+		events[string(data)] = true
+		return nil
+	}))
+	assert.Len(offsets, 200)
+	assert.Len(events, 200)
+}
+
+func TestDurableTopic(t *testing.T) {
+	assert := assert.New(t)
+	type Order struct{}
+	pkg := reflect.TypeOf(Order{}).PkgPath()
+	assert.Equal("github.com/qjpcpu/common.v2/broadcast", pkg)
+	assert.Equal("*"+pkg+".Order", durableTopic(reflect.TypeOf(&Order{})))
+	assert.Equal("map[string][]"+pkg+".Order", durableTopic(reflect.TypeOf(map[string][]Order{})))
+	assert.Equal("int", durableTopic(reflect.TypeOf(0)))
+}
+
+func TestBroadcastRequest(t *testing.T) {
+	assert := assert.New(t)
+	type Query struct {
+		Name string
+	}
+	type Answer struct {
+		Greeting string
+	}
+	b := NewTypedBroadcaster()
+	ctx := context.Background()
+	_, err := b.Request(ctx, &Query{Name: "A"})
+	assert.Equal(ErrNoResponder, err)
+
+	stub, err := b.AddResponder(func(ctx context.Context, q *Query) (*Answer, error) {
+		if q.Name == "" {
+			return nil, errors.New("empty name")
+		}
+		if q.Name == "slow" {
+			<-ctx.Done()
+		}
+		return &Answer{Greeting: "hello " + q.Name}, nil
+	})
+	assert.NoError(err)
+	_, err = b.AddResponder(func(ctx context.Context, q *Query) (*Answer, error) { return nil, nil })
+	assert.Equal(ErrResponderExists, err)
+
+	res, err := b.Request(ctx, &Query{Name: "A"})
+	assert.NoError(err)
+	assert.Equal("hello A", res.(*Answer).Greeting)
+
+	_, err = b.Request(ctx, &Query{})
+	assert.EqualError(err, "empty name")
+
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	_, err = b.Request(tctx, &Query{Name: "slow"})
+	assert.Equal(context.DeadlineExceeded, err)
+
+	stub.Unsubscribe()
+	stub.Wait()
+	_, err = b.Request(ctx, &Query{Name: "A"})
+	assert.Equal(ErrNoResponder, err)
+	b.Stop()
+}
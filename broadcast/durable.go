@@ -0,0 +1,193 @@
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/qjpcpu/common.v2/cli"
+)
+
+// EventStore is an append only event log, offsets of a topic start from 1
+type EventStore interface {
+	Append(topic string, data []byte) (offset uint64, err error)
+	// ReadFrom call fn with events after offset in order
+	ReadFrom(topic string, offset uint64, fn func(offset uint64, data []byte) error) error
+	Ack(topic, consumer string, offset uint64) error
+	Acked(topic, consumer string) (offset uint64, err error)
+}
+
+// WithEventStore persist JSON encoded payloads before dispatching,
+// listeners added with WithDurableName get unacknowledged events redelivered
+func WithEventStore(store EventStore) BroadcasterOption {
+	return func(opt *broadcasterOptions) {
+		opt.Store = store
+	}
+}
+
+// WithDurableName identify a listener across restarts, it acknowledges an event after processing it without error,
+// a failure or a drop by backlog policy stops acknowledgement so that event and later ones are redelivered on restart.
+// Durable listeners must listen on concrete types and process messages in order
+func WithDurableName(name string) ListenerOption {
+	return func(opt *listenerOptions) {
+		opt.DurableName = name
+	}
+}
+
+type durableLog struct {
+	store EventStore
+	topic string
+}
+
+func newDurableLog(store EventStore, typ reflect.Type) *durableLog {
+	if store == nil || isWildType(typ) {
+		return nil
+	}
+	return &durableLog{store: store, topic: durableTopic(typ)}
+}
+
+// durableTopic name typ by package path rather than package name, so that a/event.Order and b/event.Order do not share a log
+func durableTopic(typ reflect.Type) string {
+	if typ.Name() != "" {
+		if typ.PkgPath() == "" {
+			return typ.Name()
+		}
+		return typ.PkgPath() + "." + typ.Name()
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return "*" + durableTopic(typ.Elem())
+	case reflect.Slice:
+		return "[]" + durableTopic(typ.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", typ.Len(), durableTopic(typ.Elem()))
+	case reflect.Map:
+		return "map[" + durableTopic(typ.Key()) + "]" + durableTopic(typ.Elem())
+	}
+	return typ.String()
+}
+
+func (dl *durableLog) Append(v interface{}) (uint64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return dl.store.Append(dl.topic, data)
+}
+
+// Redeliver put events not acknowledged by consumer into l
+func (dl *durableLog) Redeliver(l *listener, typ reflect.Type) error {
+	offset, err := dl.store.Acked(dl.topic, l.durable.name)
+	if err != nil {
+		return err
+	}
+	return dl.store.ReadFrom(dl.topic, offset, func(offset uint64, data []byte) error {
+		v := reflect.New(typ)
+		if err := json.Unmarshal(data, v.Interface()); err != nil {
+			return err
+		}
+		msg := message{Payload: newPayload(context.Background(), v.Elem().Interface()), Offset: offset}
+		if l.mb.Put(msg) == putDetach {
+			return ErrMessageDropped
+		}
+		return nil
+	})
+}
+
+// durableConsumer tracks acknowledged offset of a listener
+type durableConsumer struct {
+	log     *durableLog
+	name    string
+	failed  bool
+	dropped uint64 // first offset dropped by backlog policy
+}
+
+func (dc *durableConsumer) Commit(msg message, err error) {
+	if dc == nil || msg.Offset == 0 || dc.failed {
+		return
+	}
+	/* acking past a dropped event would lose it */
+	if dropped := atomic.LoadUint64(&dc.dropped); err != nil || (dropped != 0 && msg.Offset > dropped) {
+		dc.failed = true
+		return
+	}
+	if err = dc.log.store.Ack(dc.log.topic, dc.name, msg.Offset); err != nil {
+		log.Printf("broadcast: ack %s of %s: %v", dc.log.topic, dc.name, err)
+	}
+}
+
+// Drop stop acknowledgement from msg, mailbox drops messages in offset order
+func (dc *durableConsumer) Drop(msg message) {
+	if msg.Offset != 0 {
+		atomic.CompareAndSwapUint64(&dc.dropped, 0, msg.Offset)
+	}
+}
+
+type fileDBStore struct {
+	kv *cli.BucketKV
+}
+
+// NewFileDBStore create EventStore in bucket of db
+func NewFileDBStore(db *cli.FileDB, bucket string) EventStore {
+	return &fileDBStore{kv: db.GetBucketKV(bucket)}
+}
+
+// Append read and bump head in one transaction, so stores sharing a bucket never hand out the same offset
+func (s *fileDBStore) Append(topic string, data []byte) (offset uint64, err error) {
+	err = s.kv.Transaction(func(tx *cli.BucketTx) error {
+		var head uint64
+		if err := tx.Get(topic+"/head", &head); err != nil && !cli.IsNotFound(err) {
+			return err
+		}
+		offset = head + 1
+		if err := tx.Put(s.eventKey(topic, offset), json.RawMessage(data)); err != nil {
+			return err
+		}
+		return tx.Put(topic+"/head", offset)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (s *fileDBStore) ReadFrom(topic string, offset uint64, fn func(uint64, []byte) error) error {
+	head, err := s.getOffset(topic + "/head")
+	if err != nil {
+		return err
+	}
+	for i := offset + 1; i <= head; i++ {
+		var data json.RawMessage
+		if err := s.kv.Get(s.eventKey(topic, i), &data); err != nil {
+			return err
+		}
+		if err := fn(i, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileDBStore) Ack(topic, consumer string, offset uint64) error {
+	return s.kv.Put(topic+"/ack/"+consumer, offset)
+}
+
+func (s *fileDBStore) Acked(topic, consumer string) (uint64, error) {
+	return s.getOffset(topic + "/ack/" + consumer)
+}
+
+func (s *fileDBStore) eventKey(topic string, offset uint64) string {
+	return fmt.Sprintf("%s/event/%020d", topic, offset)
+}
+
+// getOffset treat missing key as zero, other errors are returned
+func (s *fileDBStore) getOffset(key string) (uint64, error) {
+	var offset uint64
+	if err := s.kv.Get(key, &offset); err != nil && !cli.IsNotFound(err) {
+		return 0, err
+	}
+	return offset, nil
+}
@@ -0,0 +1,98 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrMessageDropped is reported to Publish when a listener's backlog overflowed
+	ErrMessageDropped = errors.New("broadcast: message dropped")
+)
+
+// PanicError wraps a panic recovered from a listener
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func newPanicError(r interface{}) *PanicError {
+	const size = 64 << 10
+	buf := make([]byte, size)
+	buf = buf[:runtime.Stack(buf, false)]
+	return &PanicError{Value: r, Stack: buf}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("broadcast: listener panic: %v", e.Value)
+}
+
+// MultiError collects errors returned by listeners
+type MultiError []error
+
+func (me MultiError) Error() string {
+	list := make([]string, 0, len(me))
+	for _, err := range me {
+		list = append(list, err.Error())
+	}
+	return strings.Join(list, "; ")
+}
+
+func (me MultiError) errorOrNil() error {
+	if len(me) == 0 {
+		return nil
+	}
+	return me
+}
+
+// ackCollector waits for a fixed number of listener acks
+type ackCollector struct {
+	mu        sync.Mutex
+	listeners int
+	remaining int
+	errs      MultiError
+	done      chan struct{}
+}
+
+func newAckCollector(n int) *ackCollector {
+	c := &ackCollector{listeners: n, remaining: n, done: make(chan struct{})}
+	if n == 0 {
+		close(c.done)
+	}
+	return c
+}
+
+func (c *ackCollector) Ack(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining == 0 {
+		return
+	}
+	if err != nil {
+		c.errs = append(c.errs, err)
+	}
+	if c.remaining--; c.remaining == 0 {
+		close(c.done)
+	}
+}
+
+func (c *ackCollector) Done() <-chan struct{} {
+	return c.done
+}
+
+func waitAcks(ctx context.Context, collectors []*ackCollector) error {
+	var errs MultiError
+	for _, c := range collectors {
+		select {
+		case <-c.Done():
+			errs = append(errs, c.errs...)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errs.errorOrNil()
+}
@@ -1,38 +1,135 @@
 package broadcast
 
 import (
+	"fmt"
+	"hash/fnv"
 	"reflect"
 	"sync"
+	"time"
 )
 
-func runListenerSafe(rc chan message, stub *chanStub, fn reflect.Value) {
+type listener struct {
+	fn         reflect.Value
+	mb         *mailbox
+	stub       *chanStub
+	workers    int
+	keyFn      reflect.Value
+	obs        *observer
+	durable    *durableConsumer
+	returnsErr bool // only a single error result is reported, other results are ignored
+}
+
+func newListener(fn reflect.Value, opt *listenerOptions, obs *observer) *listener {
+	mb := newMailbox(opt.MaxBacklog, opt.Policy, obs.Dropped)
+	fnT := fn.Type()
+	return &listener{
+		fn:         fn,
+		returnsErr: fnT.NumOut() == 1 && fnT.Out(0) == errorType,
+		mb:         mb,
+		stub:       newChanStub(mb),
+		workers:    opt.Workers,
+		keyFn:      opt.KeyFn,
+		obs:        obs,
+	}
+}
+
+func runListenerSafe(l *listener) {
 	allowPanic("broadcast.listener", func() {
-		runListenerLoop(rc, stub, fn)
+		runListenerLoop(l)
 	})
 }
 
-func runListenerLoop(rc chan message, stub *chanStub, fn reflect.Value) {
+func runListenerLoop(l *listener) {
+	defer l.stub.Close()
+	if l.workers > 1 && l.durable == nil {
+		runWorkerPool(l)
+		return
+	}
+	for {
+		msg := l.mb.Get()
+		if msg.isTerminateMessage() {
+			return
+		}
+		err := l.call(msg)
+		l.durable.Commit(msg, err)
+		msg.ack(err)
+	}
+}
+
+// call invoke listener function, panics are logged unless someone observes them
+func (l *listener) call(msg message) (err error) {
+	v := msg.Payload
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			perr := newPanicError(r)
+			if !l.obs.Panic(perr, v.Body) && msg.Ack == nil {
+				logStack("broadcast.listener", r)
+			}
+			err = perr
+		}
+		l.obs.Delivered(v.Body, time.Since(start), err)
+	}()
+	out := l.fn.Call([]reflect.Value{reflect.ValueOf(v.Ctx), reflect.ValueOf(v.Body)})
+	if l.returnsErr && !out[0].IsNil() {
+		err = out[0].Interface().(error)
+	}
+	return
+}
+
+func runWorkerPool(l *listener) {
+	/* one queue per worker when key affinity is required, otherwise workers share one queue */
+	queues := make([]chan message, 1)
+	if l.keyFn.IsValid() {
+		queues = make([]chan message, l.workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan message)
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < l.workers; i++ {
+		wg.Add(1)
+		go func(queue chan message) {
+			defer wg.Done()
+			for msg := range queue {
+				msg.ack(l.call(msg))
+			}
+		}(queues[i%len(queues)])
+	}
+	defer wg.Wait()
 	for {
-		msg := <-rc
-		v := msg.Payload
-		rc <- msg
-		rc = msg.Next
+		msg := l.mb.Get()
 		if msg.isTerminateMessage() {
-			stub.Close()
+			for _, queue := range queues {
+				close(queue)
+			}
 			return
 		}
-		allowPanic("broadcast.listener", func() {
-			fn.Call([]reflect.Value{reflect.ValueOf(v.Ctx), reflect.ValueOf(v.Body)})
-		})
+		queues[l.shardOf(msg, len(queues))] <- msg
+	}
+}
+
+func (l *listener) shardOf(msg message, n int) (shard int) {
+	if n <= 1 {
+		return 0
 	}
+	allowPanic("broadcast.listener", func() {
+		key := l.keyFn.Call([]reflect.Value{reflect.ValueOf(msg.Payload.Body)})[0].Interface()
+		h := fnv.New32a()
+		fmt.Fprint(h, key)
+		shard = int(h.Sum32() % uint32(n))
+	})
+	return
 }
 
 type chanStub struct {
-	closeC chan struct{}
+	closeC      chan struct{}
+	mb          *mailbox
+	unsubscribe func()
 }
 
-func newChanStub() *chanStub {
-	return &chanStub{closeC: make(chan struct{}, 1)}
+func newChanStub(mb *mailbox) *chanStub {
+	return &chanStub{closeC: make(chan struct{}, 1), mb: mb, unsubscribe: func() { mb.Close(true) }}
 }
 
 func (c *chanStub) Close() {
@@ -43,28 +140,16 @@ func (c *chanStub) Wait() {
 	<-c.closeC
 }
 
-type chanStubList struct {
-	list []*chanStub
-	*sync.Mutex
+// Unsubscribe detach the listener, pending messages are discarded
+func (c *chanStub) Unsubscribe() {
+	c.unsubscribe()
 }
 
-func newChanStubList() *chanStubList {
-	return &chanStubList{Mutex: new(sync.Mutex)}
+func (c *chanStub) Done() <-chan struct{} {
+	return c.closeC
 }
 
-func (cl *chanStubList) Append(s *chanStub) *chanStubList {
-	cl.Lock()
-	defer cl.Unlock()
-	cl.list = append(cl.list, s)
-	return cl
-}
-
-func (cl *chanStubList) Wait() {
-	cl.Lock()
-	defer cl.Unlock()
-	for _, item := range cl.list {
-		item.Wait()
-	}
-	// reset
-	cl.list = cl.list[:0]
+// Lag return count of messages not yet processed
+func (c *chanStub) Lag() int {
+	return c.mb.Len()
 }
@@ -0,0 +1,149 @@
+package broadcast
+
+import (
+	"context"
+	"sync"
+)
+
+type putResult int
+
+const (
+	putOK putResult = iota
+	putDropped
+	putDetach
+	putCancelled
+)
+
+// mailbox is the pending queue of a single listener
+type mailbox struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    []message
+	max      int
+	policy   OverflowPolicy
+	closed   bool
+	onDrop   func(message)
+}
+
+func newMailbox(max int, policy OverflowPolicy, onDrop func(message)) *mailbox {
+	mb := &mailbox{max: max, policy: policy, onDrop: onDrop}
+	mb.notEmpty = sync.NewCond(&mb.mu)
+	mb.notFull = sync.NewCond(&mb.mu)
+	return mb
+}
+
+func (mb *mailbox) Put(msg message) putResult {
+	return mb.PutContext(context.Background(), msg)
+}
+
+// PutContext give up blocking on full backlog once ctx is done, the message is not enqueued then
+func (mb *mailbox) PutContext(ctx context.Context, msg message) putResult {
+	res, dropped := mb.put(ctx, msg)
+	mb.drop(dropped)
+	return res
+}
+
+func (mb *mailbox) put(ctx context.Context, msg message) (putResult, []message) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return putDropped, []message{msg}
+	}
+	var dropped []message
+	var stop chan struct{}
+	for mb.max > 0 && len(mb.queue) >= mb.max {
+		switch mb.policy {
+		case DropOldest:
+			dropped = append(dropped, mb.pop())
+		case DropNewest:
+			return putDropped, []message{msg}
+		case BlockSender:
+			if ctx.Err() != nil {
+				return putCancelled, nil
+			}
+			/* cond can not select on ctx, wake waiters once it is done */
+			if stop == nil && ctx.Done() != nil {
+				stop = make(chan struct{})
+				defer close(stop)
+				go func() {
+					select {
+					case <-ctx.Done():
+						mb.mu.Lock()
+						mb.notFull.Broadcast()
+						mb.mu.Unlock()
+					case <-stop:
+					}
+				}()
+			}
+			mb.notFull.Wait()
+			if mb.closed {
+				return putDropped, []message{msg}
+			}
+		default:
+			return putDetach, []message{msg}
+		}
+	}
+	mb.queue = append(mb.queue, msg)
+	mb.notEmpty.Signal()
+	return putOK, dropped
+}
+
+// drop is called without lock since hooks may inspect the mailbox
+func (mb *mailbox) drop(list []message) {
+	for _, msg := range list {
+		msg.ack(ErrMessageDropped)
+		if mb.onDrop != nil {
+			mb.onDrop(msg)
+		}
+	}
+}
+
+func (mb *mailbox) Get() message {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for len(mb.queue) == 0 {
+		mb.notEmpty.Wait()
+	}
+	msg := mb.pop()
+	mb.notFull.Signal()
+	return msg
+}
+
+// Close enqueue termination after pending messages, or instead of them when discard is true
+func (mb *mailbox) Close(discard bool) {
+	mb.mu.Lock()
+	if mb.closed {
+		mb.mu.Unlock()
+		return
+	}
+	mb.closed = true
+	var dropped []message
+	if discard {
+		for len(mb.queue) > 0 {
+			dropped = append(dropped, mb.pop())
+		}
+	}
+	mb.queue = append(mb.queue, terminationMsg)
+	mb.notEmpty.Signal()
+	mb.notFull.Broadcast()
+	mb.mu.Unlock()
+	mb.drop(dropped)
+}
+
+func (mb *mailbox) Len() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	size := len(mb.queue)
+	if size > 0 && mb.queue[size-1].isTerminateMessage() {
+		size--
+	}
+	return size
+}
+
+func (mb *mailbox) pop() message {
+	msg := mb.queue[0]
+	mb.queue[0] = message{}
+	mb.queue = mb.queue[1:]
+	return msg
+}
@@ -11,20 +11,29 @@ type payload struct {
 	Body interface{}
 }
 
-func newPayload(ctx context.Context,body interface{}) payload {
-	return payload{Ctx: ctx,Body:body}
+func newPayload(ctx context.Context, body interface{}) payload {
+	return payload{Ctx: ctx, Body: body}
 }
 
 type message struct {
-	Next    chan message
 	Payload payload
 	Flag    uint32
+	// Ack is set by Publish, called once the listener is done with the message
+	Ack func(error)
+	// Offset in event store, 0 if not persisted
+	Offset uint64
 }
 
 func (b message) isTerminateMessage() bool {
 	return b.Flag&terminateMask != 0
 }
 
+func (b message) ack(err error) {
+	if b.Ack != nil {
+		b.Ack(err)
+	}
+}
+
 var (
-	terminationMsg = message{Payload: payload{ Ctx:context.TODO()}, Flag:terminateMask}
-)
\ No newline at end of file
+	terminationMsg = message{Payload: payload{Ctx: context.TODO()}, Flag: terminateMask}
+)
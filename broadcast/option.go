@@ -0,0 +1,107 @@
+package broadcast
+
+import (
+	"reflect"
+	"time"
+)
+
+// OverflowPolicy decides what to do when a listener's backlog is full
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest pending message to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the incoming message
+	DropNewest
+	// BlockSender blocks Notify until the listener catches up, Publish also gives up once its ctx is done
+	BlockSender
+	// AutoUnsubscribe detaches the listener, pending messages are discarded
+	AutoUnsubscribe
+)
+
+type listenerOptions struct {
+	MaxBacklog  int
+	Policy      OverflowPolicy
+	Workers     int
+	KeyFn       reflect.Value
+	DurableName string
+}
+
+type ListenerOption func(*listenerOptions)
+
+/* private methods */
+func newListenerOptions(opts ...ListenerOption) *listenerOptions {
+	opt := &listenerOptions{}
+	for _, fn := range opts {
+		fn(opt)
+	}
+	return opt
+}
+
+// WithMaxBacklog bounds pending messages of a listener, size <= 0 means unbounded
+func WithMaxBacklog(size int, policy OverflowPolicy) ListenerOption {
+	return func(opt *listenerOptions) {
+		opt.MaxBacklog = size
+		opt.Policy = policy
+	}
+}
+
+// WithWorkers process messages of a listener with n goroutines, message order is not kept
+func WithWorkers(n int) ListenerOption {
+	return func(opt *listenerOptions) {
+		opt.Workers = n
+	}
+}
+
+// WithKeyAffinity process messages with n workers, messages with the same key are processed in order,
+// keyFn must like func(Args) Key
+func WithKeyAffinity(n int, keyFn interface{}) ListenerOption {
+	return func(opt *listenerOptions) {
+		opt.Workers = n
+		opt.KeyFn = reflect.ValueOf(keyFn)
+	}
+}
+
+type broadcasterOptions struct {
+	ReplaySize     int
+	TypeReplaySize map[reflect.Type]int
+	OnPanic        func(PanicInfo)
+	OnDelivered    func(reflect.Type, time.Duration, error)
+	OnDropped      func(reflect.Type)
+	Store          EventStore
+}
+
+type BroadcasterOption func(*broadcasterOptions)
+
+func newBroadcasterOptions(opts ...BroadcasterOption) *broadcasterOptions {
+	opt := &broadcasterOptions{TypeReplaySize: make(map[reflect.Type]int)}
+	for _, fn := range opts {
+		fn(opt)
+	}
+	return opt
+}
+
+func (opt *broadcasterOptions) replaySizeOf(typ reflect.Type) int {
+	if size, ok := opt.TypeReplaySize[typ]; ok {
+		return size
+	}
+	return opt.ReplaySize
+}
+
+// WithReplay keep last size messages per type and replay them to new listeners,
+// it applies to types of samples, or all types if no sample given
+func WithReplay(size int, samples ...interface{}) BroadcasterOption {
+	return func(opt *broadcasterOptions) {
+		if len(samples) == 0 {
+			opt.ReplaySize = size
+		}
+		for _, sample := range samples {
+			opt.TypeReplaySize[reflect.TypeOf(sample)] = size
+		}
+	}
+}
+
+// WithSticky keep only the latest value, like a config snapshot
+func WithSticky(samples ...interface{}) BroadcasterOption {
+	return WithReplay(1, samples...)
+}
@@ -0,0 +1,91 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+var (
+	ErrNoResponder     = errors.New("broadcast: no responder")
+	ErrResponderExists = errors.New("broadcast: responder exists")
+)
+
+type replyContextKey struct{}
+
+// replySlot carry response of responder back to requester
+type replySlot struct {
+	sync.Mutex
+	Value interface{}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// AddResponder register the only responder of request type, fn must like func(context.Context,Req) (Resp,error)
+func (tb *typedbroadcasterInstance) AddResponder(fn interface{}, opts ...ListenerOption) (ListenerStub, error) {
+	fnV := reflect.ValueOf(fn)
+	fnT := fnV.Type()
+	if fnT.Kind() != reflect.Func || fnT.NumIn() != 2 || fnT.NumOut() != 2 || !fnT.Out(1).Implements(errorType) {
+		return nil, errors.New("broadcast: responder must like func(context.Context,Req) (Resp,error)")
+	}
+	bType := fnT.In(1)
+	tb.Lock()
+	defer tb.Unlock()
+	ins, ok := tb.responderMap[bType]
+	if ok && len(ins.getListeners()) > 0 {
+		return nil, ErrResponderExists
+	} else if !ok {
+		ins = newInstance(0, tb.obs, nil)
+		tb.responderMap[bType] = ins
+	}
+	return ins.AddListener(wrapResponder(fnV), newListenerOptions(opts...)), nil
+}
+
+// Request send req to its responder and wait for the response
+func (tb *typedbroadcasterInstance) Request(ctx context.Context, req interface{}) (interface{}, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tb.RLock()
+	ins, ok := tb.responderMap[reflect.TypeOf(req)]
+	tb.RUnlock()
+	if !ok || len(ins.getListeners()) == 0 {
+		return nil, ErrNoResponder
+	}
+	slot := &replySlot{}
+	ctx = context.WithValue(ctx, replyContextKey{}, slot)
+	/* responder may unsubscribe after the check above */
+	collector := ins.Publish(ctx, req)
+	if collector.listeners == 0 {
+		return nil, ErrNoResponder
+	}
+	if err := waitAcks(ctx, []*ackCollector{collector}); err != nil {
+		if me, ok := err.(MultiError); ok && len(me) == 1 {
+			err = me[0]
+		}
+		return nil, err
+	}
+	slot.Lock()
+	defer slot.Unlock()
+	return slot.Value, nil
+}
+
+// wrapResponder convert func(ctx,Req) (Resp,error) to listener func(ctx,Req) error which stores Resp into reply slot
+func wrapResponder(fn reflect.Value) reflect.Value {
+	fnT := fn.Type()
+	listenerT := reflect.FuncOf([]reflect.Type{fnT.In(0), fnT.In(1)}, []reflect.Type{errorType}, false)
+	return reflect.MakeFunc(listenerT, func(args []reflect.Value) []reflect.Value {
+		out := fn.Call(args)
+		if slot, ok := args[0].Interface().(context.Context).Value(replyContextKey{}).(*replySlot); ok {
+			slot.Lock()
+			slot.Value = out[0].Interface()
+			slot.Unlock()
+		}
+		err := reflect.Zero(errorType)
+		if !out[1].IsNil() {
+			err = out[1].Convert(errorType)
+		}
+		return []reflect.Value{err}
+	})
+}
@@ -0,0 +1,188 @@
+package broadcast
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// PanicInfo describe a panic recovered from a listener
+type PanicInfo struct {
+	Value       interface{}
+	Stack       []byte
+	PayloadType reflect.Type
+}
+
+// WithPanicHook replace default panic logging of listeners
+func WithPanicHook(fn func(PanicInfo)) BroadcasterOption {
+	return func(opt *broadcasterOptions) {
+		opt.OnPanic = fn
+	}
+}
+
+// WithDeliveredHook is called after a listener processed a message, err is returned or recovered from the listener
+func WithDeliveredHook(fn func(payloadType reflect.Type, cost time.Duration, err error)) BroadcasterOption {
+	return func(opt *broadcasterOptions) {
+		opt.OnDelivered = fn
+	}
+}
+
+// WithDroppedHook is called when a message is dropped by a listener's overflow policy
+func WithDroppedHook(fn func(payloadType reflect.Type)) BroadcasterOption {
+	return func(opt *broadcasterOptions) {
+		opt.OnDropped = fn
+	}
+}
+
+// LatencyBuckets are upper bounds of listener latency histogram
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Stats is a snapshot of counters by payload type name
+type Stats struct {
+	Events map[string]EventStats
+}
+
+type EventStats struct {
+	Delivered uint64
+	Failed    uint64
+	Panics    uint64
+	Dropped   uint64
+	Latency   Histogram
+}
+
+// Histogram counts latency by LatencyBuckets, the last count is for latency beyond all buckets
+type Histogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Sum     time.Duration
+}
+
+type eventCounter struct {
+	sync.Mutex
+	EventStats
+}
+
+type observer struct {
+	onPanic     func(PanicInfo)
+	onDelivered func(reflect.Type, time.Duration, error)
+	onDropped   func(reflect.Type)
+	mu          sync.RWMutex
+	counters    map[reflect.Type]*eventCounter
+}
+
+func newObserver(opt *broadcasterOptions) *observer {
+	return &observer{
+		onPanic:     opt.OnPanic,
+		onDelivered: opt.OnDelivered,
+		onDropped:   opt.OnDropped,
+		counters:    make(map[reflect.Type]*eventCounter),
+	}
+}
+
+// Panic report whether the panic is handled by hook
+func (o *observer) Panic(perr *PanicError, body interface{}) bool {
+	if o == nil {
+		return false
+	}
+	typ := reflect.TypeOf(body)
+	c := o.getCounter(typ)
+	c.Lock()
+	c.Panics++
+	c.Unlock()
+	if o.onPanic == nil {
+		return false
+	}
+	o.onPanic(PanicInfo{Value: perr.Value, Stack: perr.Stack, PayloadType: typ})
+	return true
+}
+
+func (o *observer) Delivered(body interface{}, cost time.Duration, err error) {
+	if o == nil {
+		return
+	}
+	typ := reflect.TypeOf(body)
+	c := o.getCounter(typ)
+	c.Lock()
+	c.Delivered++
+	if err != nil {
+		c.Failed++
+	}
+	c.Latency.observe(cost)
+	c.Unlock()
+	if o.onDelivered != nil {
+		o.onDelivered(typ, cost, err)
+	}
+}
+
+func (o *observer) Dropped(msg message) {
+	if o == nil {
+		return
+	}
+	typ := reflect.TypeOf(msg.Payload.Body)
+	c := o.getCounter(typ)
+	c.Lock()
+	c.Dropped++
+	c.Unlock()
+	if o.onDropped != nil {
+		o.onDropped(typ)
+	}
+}
+
+func (o *observer) Stats() Stats {
+	st := Stats{Events: make(map[string]EventStats)}
+	if o == nil {
+		return st
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for typ, c := range o.counters {
+		c.Lock()
+		es := c.EventStats
+		es.Latency.Counts = append([]uint64(nil), c.Latency.Counts...)
+		c.Unlock()
+		name := "<nil>"
+		if typ != nil {
+			name = typ.String()
+		}
+		st.Events[name] = es
+	}
+	return st
+}
+
+func (o *observer) getCounter(typ reflect.Type) *eventCounter {
+	o.mu.RLock()
+	c, ok := o.counters[typ]
+	o.mu.RUnlock()
+	if ok {
+		return c
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if c, ok = o.counters[typ]; !ok {
+		c = &eventCounter{}
+		c.Latency.Buckets = LatencyBuckets
+		c.Latency.Counts = make([]uint64, len(LatencyBuckets)+1)
+		o.counters[typ] = c
+	}
+	return c
+}
+
+func (h *Histogram) observe(cost time.Duration) {
+	h.Sum += cost
+	for i, bucket := range h.Buckets {
+		if cost <= bucket {
+			h.Counts[i]++
+			return
+		}
+	}
+	h.Counts[len(h.Buckets)]++
+}
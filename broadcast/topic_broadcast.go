@@ -0,0 +1,163 @@
+package broadcast
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// TopicBroadcaster route messages by dot separated topics like order.42.created,
+// listener patterns match a segment by glob(`*`, `ord*`), `#` matches zero or more segments
+type TopicBroadcaster interface {
+	Notify(ctx context.Context, topic string, v interface{})
+	// Publish block until every matched listener processed v
+	Publish(ctx context.Context, topic string, v interface{}) error
+	AddListener(pattern string, function interface{}, opts ...ListenerOption) ListenerStub
+	// AddListenerContext unsubscribe the listener once ctx is done
+	AddListenerContext(ctx context.Context, pattern string, function interface{}, opts ...ListenerOption) ListenerStub
+	// Stats return counters of listeners by payload type
+	Stats() Stats
+	Stop()
+}
+
+// NewTopicBroadcaster create topic broadcaster, replay options are not supported
+func NewTopicBroadcaster(opts ...BroadcasterOption) TopicBroadcaster {
+	return &topicBroadcasterInstance{
+		RWMutex:      new(sync.RWMutex),
+		broadcastMap: make(map[topicKey]*broadcasterInstance),
+		obs:          newObserver(newBroadcasterOptions(opts...)),
+	}
+}
+
+type topicContextKey struct{}
+
+// TopicFromContext return topic of the message in listener
+func TopicFromContext(ctx context.Context) string {
+	topic, _ := ctx.Value(topicContextKey{}).(string)
+	return topic
+}
+
+type topicKey struct {
+	Pattern string
+	Type    reflect.Type
+}
+
+type topicBroadcasterInstance struct {
+	*sync.RWMutex
+	broadcastMap map[topicKey]*broadcasterInstance
+	// keys in registration order
+	keys []topicKey
+	obs  *observer
+}
+
+func (tb *topicBroadcasterInstance) Notify(ctx context.Context, topic string, v interface{}) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, topicContextKey{}, topic)
+	for _, broadcasterIns := range tb.getInstances(topic, reflect.TypeOf(v)) {
+		broadcasterIns.Send(ctx, v)
+	}
+}
+
+func (tb *topicBroadcasterInstance) Publish(ctx context.Context, topic string, v interface{}) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, topicContextKey{}, topic)
+	var collectors []*ackCollector
+	for _, broadcasterIns := range tb.getInstances(topic, reflect.TypeOf(v)) {
+		collectors = append(collectors, broadcasterIns.Publish(ctx, v))
+	}
+	return waitAcks(ctx, collectors)
+}
+
+func (tb *topicBroadcasterInstance) Stats() Stats {
+	return tb.obs.Stats()
+}
+
+func (tb *topicBroadcasterInstance) Stop() {
+	tb.Lock()
+	defer tb.Unlock()
+	wg := new(sync.WaitGroup)
+	for _, b := range tb.broadcastMap {
+		wg.Add(1)
+		go func(bi *broadcasterInstance) {
+			defer wg.Done()
+			allowPanic("broadcast.main", bi.Stop)
+		}(b)
+	}
+	wg.Wait()
+	/* reset map */
+	tb.broadcastMap = make(map[topicKey]*broadcasterInstance)
+	tb.keys = nil
+}
+
+// fn must like func(context.Context,Args) or func(context.Context,Args) error,
+// it only receives values assignable to Args
+func (tb *topicBroadcasterInstance) AddListener(pattern string, fn interface{}, opts ...ListenerOption) ListenerStub {
+	opt := newListenerOptions(opts...)
+	fnV := reflect.ValueOf(fn)
+	checkListener(fnV)
+	key := topicKey{Pattern: pattern, Type: fnV.Type().In(1)}
+	tb.Lock()
+	defer tb.Unlock()
+	if broadcasterIns, ok := tb.broadcastMap[key]; ok {
+		return broadcasterIns.AddListener(fnV, opt)
+	}
+	ins := newInstance(0, tb.obs, nil)
+	stub := ins.AddListener(fnV, opt)
+	tb.broadcastMap[key] = ins
+	tb.keys = append(tb.keys, key)
+	return stub
+}
+
+func (tb *topicBroadcasterInstance) AddListenerContext(ctx context.Context, pattern string, fn interface{}, opts ...ListenerOption) ListenerStub {
+	stub := tb.AddListener(pattern, fn, opts...)
+	unsubscribeOnDone(ctx, stub)
+	return stub
+}
+
+func (tb *topicBroadcasterInstance) getInstances(topic string, bType reflect.Type) []*broadcasterInstance {
+	if bType == nil {
+		return nil
+	}
+	tb.RLock()
+	defer tb.RUnlock()
+	var list []*broadcasterInstance
+	for _, key := range tb.keys {
+		if bType.AssignableTo(key.Type) && MatchTopic(key.Pattern, topic) {
+			list = append(list, tb.broadcastMap[key])
+		}
+	}
+	return list
+}
+
+// MatchTopic report whether topic matches pattern
+func MatchTopic(pattern, topic string) bool {
+	return matchSegments(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+func matchSegments(pattern, topic []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "#" {
+			/* # matches zero or more segments */
+			for i := 0; i <= len(topic); i++ {
+				if matchSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(topic) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], topic[0]); err != nil || !ok {
+			return false
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
@@ -8,41 +8,101 @@ import (
 
 type TypedBroadcaster interface {
 	Notify(context.Context, interface{})
-	AddListener(function interface{}) ListenerStub
+	// Publish block until every listener of v's type processed it, errors and panics are collected into MultiError
+	Publish(context.Context, interface{}) error
+	AddListener(function interface{}, opts ...ListenerOption) ListenerStub
+	// AddListenerContext unsubscribe the listener once ctx is done
+	AddListenerContext(ctx context.Context, function interface{}, opts ...ListenerOption) ListenerStub
+	// AddResponder register the only responder of a request type, fn must like func(context.Context,Req) (Resp,error)
+	AddResponder(function interface{}, opts ...ListenerOption) (ListenerStub, error)
+	// Request wait for response of req, ErrNoResponder is returned if nobody responds to req's type
+	Request(ctx context.Context, req interface{}) (interface{}, error)
+	// Stats return counters of listeners by payload type
+	Stats() Stats
 	Stop()
 }
 
-func NewTypedBroadcaster() TypedBroadcaster {
+func NewTypedBroadcaster(opts ...BroadcasterOption) TypedBroadcaster {
+	opt := newBroadcasterOptions(opts...)
 	return &typedbroadcasterInstance{
 		RWMutex:      new(sync.RWMutex),
 		broadcastMap: make(map[reflect.Type]*broadcasterInstance),
+		responderMap: make(map[reflect.Type]*broadcasterInstance),
+		opt:          opt,
+		obs:          newObserver(opt),
 	}
 }
 
 type ListenerStub interface {
 	Wait()
+	// Lag return count of messages waiting to be processed by the listener
+	Lag() int
+	// Unsubscribe detach the listener without stopping the broadcaster
+	Unsubscribe()
 }
 
 type typedbroadcasterInstance struct {
 	*sync.RWMutex
 	broadcastMap map[reflect.Type]*broadcasterInstance
+	responderMap map[reflect.Type]*broadcasterInstance
+	// interface types in registration order
+	wildcardTypes []reflect.Type
+	opt           *broadcasterOptions
+	obs           *observer
 }
 
 func (tb *typedbroadcasterInstance) Notify(ctx context.Context, v interface{}) {
-	bType := reflect.TypeOf(v)
+	for _, broadcasterIns := range tb.getInstances(reflect.TypeOf(v)) {
+		broadcasterIns.Send(ctx, v)
+	}
+}
+
+func (tb *typedbroadcasterInstance) Publish(ctx context.Context, v interface{}) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var collectors []*ackCollector
+	for _, broadcasterIns := range tb.getInstances(reflect.TypeOf(v)) {
+		collectors = append(collectors, broadcasterIns.Publish(ctx, v))
+	}
+	return waitAcks(ctx, collectors)
+}
+
+// getInstances return exact type listeners first, then interface listeners in registration order
+func (tb *typedbroadcasterInstance) getInstances(bType reflect.Type) []*broadcasterInstance {
+	if bType == nil {
+		return nil
+	}
+	if tb.opt.replaySizeOf(bType) > 0 || tb.opt.Store != nil {
+		/* replay and event log must be recorded even if nobody listens yet */
+		tb.Lock()
+		tb.getOrCreateInstance(bType)
+		tb.Unlock()
+	}
 	tb.RLock()
 	defer tb.RUnlock()
+	var list []*broadcasterInstance
 	if broadcasterIns, ok := tb.broadcastMap[bType]; ok {
-		broadcasterIns.Send(ctx, v)
+		list = append(list, broadcasterIns)
 	}
+	for _, typ := range tb.wildcardTypes {
+		if typ != bType && bType.Implements(typ) {
+			list = append(list, tb.broadcastMap[typ])
+		}
+	}
+	return list
+}
+
+func (tb *typedbroadcasterInstance) Stats() Stats {
+	return tb.obs.Stats()
 }
 
 func (tb *typedbroadcasterInstance) Stop() {
 	tb.Lock()
 	defer tb.Unlock()
 	wg := new(sync.WaitGroup)
-	for _, b := range tb.broadcastMap {
-		if b != nil {
+	for _, m := range []map[reflect.Type]*broadcasterInstance{tb.broadcastMap, tb.responderMap} {
+		for _, b := range m {
 			wg.Add(1)
 			go func(bi *broadcasterInstance) {
 				defer wg.Done()
@@ -53,21 +113,39 @@ func (tb *typedbroadcasterInstance) Stop() {
 	wg.Wait()
 	/* reset map */
 	tb.broadcastMap = make(map[reflect.Type]*broadcasterInstance)
+	tb.responderMap = make(map[reflect.Type]*broadcasterInstance)
+	tb.wildcardTypes = nil
 }
 
-// fn must like func(context.Context,Args)
-func (tb *typedbroadcasterInstance) AddListener(fn interface{}) ListenerStub {
+// fn must like func(context.Context,Args) or func(context.Context,Args) error,
+// if Args is an interface type, the listener receives every value implementing it
+func (tb *typedbroadcasterInstance) AddListener(fn interface{}, opts ...ListenerOption) ListenerStub {
+	opt := newListenerOptions(opts...)
 	fnV := reflect.ValueOf(fn)
+	checkListener(fnV)
 	fnT := fnV.Type()
 	bType := fnT.In(1)
 	tb.Lock()
-	defer tb.Unlock()
+	broadcasterIns := tb.getOrCreateInstance(bType)
+	tb.Unlock()
+	return broadcasterIns.AddListener(fnV, opt)
+}
+
+// getOrCreateInstance must be called with lock held
+func (tb *typedbroadcasterInstance) getOrCreateInstance(bType reflect.Type) *broadcasterInstance {
 	if broadcasterIns, ok := tb.broadcastMap[bType]; ok {
-		return broadcasterIns.AddListener(fnV)
-	} else {
-		ins := newInstance()
-		stub := ins.AddListener(fnV)
-		tb.broadcastMap[bType] = ins
-		return stub
+		return broadcasterIns
+	}
+	ins := newInstance(tb.opt.replaySizeOf(bType), tb.obs, newDurableLog(tb.opt.Store, bType))
+	tb.broadcastMap[bType] = ins
+	if isWildType(bType) {
+		tb.wildcardTypes = append(tb.wildcardTypes, bType)
 	}
+	return ins
+}
+
+func (tb *typedbroadcasterInstance) AddListenerContext(ctx context.Context, fn interface{}, opts ...ListenerOption) ListenerStub {
+	stub := tb.AddListener(fn, opts...)
+	unsubscribeOnDone(ctx, stub)
+	return stub
 }
@@ -1,7 +1,10 @@
 package broadcast
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"reflect"
 	"runtime"
 	"runtime/debug"
 )
@@ -22,3 +25,33 @@ var logStack = func(tag string, r interface{}) {
 	log.Printf("%s panic: %s: %s", tag, r, buf)
 	debug.PrintStack()
 }
+
+func unsubscribeOnDone(ctx context.Context, stub ListenerStub) {
+	cs, ok := stub.(*chanStub)
+	if !ok || ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			cs.Unsubscribe()
+		case <-cs.Done():
+		}
+	}()
+}
+
+func isWildType(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Interface
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// checkListener panic on registering invalid listener rather than on every message
+func checkListener(fnV reflect.Value) {
+	if !fnV.IsValid() || fnV.Kind() != reflect.Func {
+		panic(fmt.Sprintf("broadcast: listener must be a function, got %v", fnV))
+	}
+	if fnT := fnV.Type(); fnT.NumIn() != 2 || fnT.IsVariadic() || !contextType.AssignableTo(fnT.In(0)) {
+		panic(fmt.Sprintf("broadcast: listener must like func(context.Context,Args) or func(context.Context,Args) error, got %v", fnT))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/qjpcpu/common.v2/assert"
@@ -197,6 +198,36 @@ func (kv *BucketKV) Get(key string, valPtr interface{}) error {
 		})
 }
 
+// BucketTx is a read-write transaction of a bucket
+type BucketTx struct {
+	tx     *nutsdb.Tx
+	bucket string
+}
+
+// Transaction run fn in one read-write transaction, transactions are serialized so read and update in fn are atomic
+func (kv *BucketKV) Transaction(fn func(tx *BucketTx) error) error {
+	return kv.DB.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return fn(&BucketTx{tx: tx, bucket: kv.bucket})
+		})
+}
+
+func (t *BucketTx) Get(key string, valPtr interface{}) error {
+	e, err := t.tx.Get(t.bucket, []byte(key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(e.Value, valPtr)
+}
+
+func (t *BucketTx) Put(key string, val interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return t.tx.Put(t.bucket, []byte(key), data, 0)
+}
+
 func (kv *BucketKV) Delete(key string) error {
 	return kv.DB.db.Update(
 		func(tx *nutsdb.Tx) error {
@@ -216,3 +247,8 @@ func (kv *BucketKV) GetBytes(key string) []byte {
 func (kv *BucketKV) GetString(key string) string {
 	return string(kv.GetBytes(key))
 }
+
+// IsNotFound tell whether error of Get means the key or bucket does not exist
+func IsNotFound(err error) bool {
+	return err == nutsdb.ErrKeyNotFound || err == nutsdb.ErrNotFoundKey || (err != nil && strings.HasPrefix(err.Error(), "not found bucket:"))
+}
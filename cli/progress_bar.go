@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -63,6 +64,72 @@ func (p *Progress) NewBar(name string, duration time.Duration) ProgressBar {
 	return bs
 }
 
+// ByteBar is a progress bar driven by transferred bytes
+type ByteBar struct {
+	bar   *uiprogress.Bar
+	mu    sync.Mutex
+	done  int64
+	total int64
+	once  *sync.Once
+}
+
+const byteBarScale = 1000
+
+// NewByteBar create bar of total bytes, total less than zero means unknown yet
+func (p *Progress) NewByteBar(name string, total int64) *ByteBar {
+	bb := &ByteBar{bar: p.p.AddBar(byteBarScale), total: total, once: new(sync.Once)}
+	bb.bar.AppendCompleted()
+	bb.bar.AppendFunc(func(b *uiprogress.Bar) string {
+		bb.mu.Lock()
+		defer bb.mu.Unlock()
+		if bb.total < 0 {
+			return formatBytes(bb.done)
+		}
+		return formatBytes(bb.done) + "/" + formatBytes(bb.total)
+	})
+	bb.bar.PrependElapsed()
+	if name != "" {
+		bb.bar.PrependFunc(func(b *uiprogress.Bar) string {
+			return name
+		})
+	}
+	p.Bars = append(p.Bars, bb)
+	return bb
+}
+
+// Update set transferred bytes, it can be used as progress callback of http downloading
+func (bb *ByteBar) Update(done, total int64) {
+	bb.mu.Lock()
+	bb.done, bb.total = done, total
+	bb.mu.Unlock()
+	if total > 0 {
+		bb.bar.Set(int(done * byteBarScale / total))
+	}
+}
+
+func (bb *ByteBar) Finish() {
+	bb.once.Do(func() {
+		bb.bar.Set(byteBarScale)
+	})
+}
+
+func (bb *ByteBar) Cancel() {
+	bb.once.Do(func() {})
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func (b *Progress) Stop() {
 	b.p.Stop()
 }
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff return wait duration before next retry, attempt starts at zero, prev is the last wait
+type Backoff func(attempt int, prev time.Duration) time.Duration
+
+func ConstantBackoff(wait time.Duration) Backoff {
+	return func(int, time.Duration) time.Duration {
+		return wait
+	}
+}
+
+func LinearJitterBackoff(min, max time.Duration) Backoff {
+	return func(attempt int, _ time.Duration) time.Duration {
+		return linearJitterBackoff(min, max, attempt)
+	}
+}
+
+// ExponentialBackoff wait min*2^attempt, capped by max
+func ExponentialBackoff(min, max time.Duration) Backoff {
+	return func(attempt int, _ time.Duration) time.Duration {
+		wait := min
+		for i := 0; i < attempt && wait < max; i++ {
+			wait *= 2
+		}
+		if wait > max {
+			wait = max
+		}
+		return wait
+	}
+}
+
+// DecorrelatedJitterBackoff wait random duration between min and 3 times of last wait, capped by max
+func DecorrelatedJitterBackoff(min, max time.Duration) Backoff {
+	return func(_ int, prev time.Duration) time.Duration {
+		if prev < min {
+			prev = min
+		}
+		upper := prev * 3
+		if upper <= min {
+			return min
+		}
+		rand := rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
+		wait := min + time.Duration(rand.Int63n(int64(upper-min)))
+		if wait > max {
+			wait = max
+		}
+		return wait
+	}
+}
@@ -0,0 +1,368 @@
+package http
+
+import (
+	"bytes"
+	"container/list"
+	syshttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qjpcpu/common.v2/cli"
+)
+
+type cacheMode int
+
+const (
+	cacheDefault cacheMode = iota
+	cacheBypass
+	cacheRefresh
+)
+
+// CachedResponse is a stored response, ExpiresAt is the end of freshness
+type CachedResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Status     string              `json:"status"`
+	Header     map[string][]string `json:"header"`
+	Body       []byte              `json:"body"`
+	Vary       map[string]string   `json:"vary,omitempty"`
+	StoredAt   time.Time           `json:"stored_at"`
+	ExpiresAt  time.Time           `json:"expires_at"`
+}
+
+func (c *CachedResponse) fresh(now time.Time) bool {
+	return now.Before(c.ExpiresAt)
+}
+
+func (c *CachedResponse) response(req *syshttp.Request) *syshttp.Response {
+	return &syshttp.Response{
+		Status:        c.Status,
+		StatusCode:    c.StatusCode,
+		Header:        syshttp.Header(c.Header).Clone(),
+		Body:          &repeatableReader{Reader: bytes.NewReader(c.Body)},
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+	}
+}
+
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, entry *CachedResponse)
+	Delete(key string)
+}
+
+type CacheOption struct {
+	Store      CacheStore                    // optional, default memory store of 1024 entries
+	KeyFunc    func(*syshttp.Request) string // optional, default method and url
+	DefaultTTL time.Duration                 // optional, freshness of response without max-age or Expires, default 0 means always revalidate
+}
+
+// CacheMiddleware cache GET responses as a private cache, honoring Cache-Control, Expires, ETag and Last-Modified.
+// Stale responses with validators are revalidated by conditional requests, unsafe methods invalidate cached url
+func CacheMiddleware(opt CacheOption) Middleware {
+	if opt.Store == nil {
+		opt.Store = NewMemoryCacheStore(1024)
+	}
+	if opt.KeyFunc == nil {
+		opt.KeyFunc = func(req *syshttp.Request) string {
+			return req.Method + " " + req.URL.String()
+		}
+	}
+	c := &httpCache{opt: opt}
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).Cache = c
+			return next(req)
+		}
+	}
+}
+
+// WithCacheBypass neither read nor write cache
+func WithCacheBypass() Option {
+	return withCacheMode(cacheBypass)
+}
+
+// WithCacheRefresh ignore fresh cache, revalidate or fetch then update cache
+func WithCacheRefresh() Option {
+	return withCacheMode(cacheRefresh)
+}
+
+func withCacheMode(mode cacheMode) Option {
+	return WithMiddleware(func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).CacheMode = mode
+			return next(req)
+		}
+	})
+}
+
+type httpCache struct {
+	opt CacheOption
+}
+
+func middlewareCache(c *httpCache, mode cacheMode) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			if mode == cacheBypass {
+				return next(req)
+			}
+			if req.Method != "GET" {
+				res, err := next(req)
+				c.invalidate(req, res, err)
+				return res, err
+			}
+			/* caller does conditional request itself */
+			if hasAnyHeader(req.Header, "If-None-Match", "If-Modified-Since", "Range") || cacheDirectives(req.Header)["no-store"] {
+				return next(req)
+			}
+			key := c.opt.KeyFunc(req)
+			entry, ok := c.opt.Store.Get(key)
+			if ok && !entry.matchVary(req) {
+				entry, ok = nil, false
+			}
+			now := time.Now()
+			if ok && mode != cacheRefresh && !cacheDirectives(req.Header)["no-cache"] && entry.fresh(now) {
+				return entry.response(req), nil
+			}
+
+			/* revalidate stale entry */
+			origin := req
+			if ok {
+				if etag := syshttp.Header(entry.Header).Get("ETag"); etag != "" {
+					req = cloneRequestHeader(req)
+					req.Header.Set("If-None-Match", etag)
+				}
+				if lm := syshttp.Header(entry.Header).Get("Last-Modified"); lm != "" {
+					req = cloneRequestHeader(req)
+					req.Header.Set("If-Modified-Since", lm)
+				}
+			}
+			res, err := next(req)
+			if err != nil {
+				return res, err
+			}
+			if ok && res.StatusCode == syshttp.StatusNotModified {
+				drainBody(res.Body)
+				for k, v := range res.Header {
+					entry.Header[k] = v
+				}
+				entry.StoredAt = now
+				entry.ExpiresAt = c.expiresAt(syshttp.Header(entry.Header), now)
+				c.opt.Store.Set(key, entry)
+				return entry.response(origin), nil
+			}
+			c.store(key, origin, res, now)
+			return res, err
+		}
+	}
+}
+
+func (c *httpCache) store(key string, req *syshttp.Request, res *syshttp.Response, now time.Time) {
+	switch res.StatusCode {
+	case 200, 203, 204, 301, 404, 410:
+	default:
+		return
+	}
+	directives := cacheDirectives(res.Header)
+	if directives["no-store"] || res.Header.Get("Vary") == "*" {
+		return
+	}
+	expiresAt := c.expiresAt(res.Header, now)
+	hasValidator := res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != ""
+	if !expiresAt.After(now) && !hasValidator {
+		return
+	}
+	body, err := RepeatableReadResponse(res)
+	if err != nil {
+		return
+	}
+	entry := &CachedResponse{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Header:     res.Header.Clone(),
+		Body:       body,
+		StoredAt:   now,
+		ExpiresAt:  expiresAt,
+	}
+	if vary := res.Header.Get("Vary"); vary != "" {
+		entry.Vary = make(map[string]string)
+		for _, name := range strings.Split(vary, ",") {
+			name = syshttp.CanonicalHeaderKey(strings.TrimSpace(name))
+			entry.Vary[name] = req.Header.Get(name)
+		}
+	}
+	c.opt.Store.Set(key, entry)
+}
+
+// expiresAt compute freshness by max-age, then Expires, then default ttl
+func (c *httpCache) expiresAt(header syshttp.Header, now time.Time) time.Time {
+	directives := cacheDirectives(header)
+	if directives["no-cache"] {
+		return now
+	}
+	if val, ok := cacheDirectiveValue(header, "max-age"); ok {
+		if sec, err := strconv.Atoi(val); err == nil {
+			if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+				sec -= age
+			}
+			return now.Add(time.Duration(sec) * time.Second)
+		}
+	}
+	if val := header.Get("Expires"); val != "" {
+		expires, err := syshttp.ParseTime(val)
+		if err != nil {
+			return now
+		}
+		if date, err := syshttp.ParseTime(header.Get("Date")); err == nil {
+			return now.Add(expires.Sub(date))
+		}
+		return expires
+	}
+	return now.Add(c.opt.DefaultTTL)
+}
+
+// invalidate cached GET of url after successful unsafe request
+func (c *httpCache) invalidate(req *syshttp.Request, res *syshttp.Response, err error) {
+	switch req.Method {
+	case "HEAD", "OPTIONS", "TRACE":
+		return
+	}
+	if err != nil || res.StatusCode >= 400 {
+		return
+	}
+	r := req.WithContext(req.Context())
+	r.Method = "GET"
+	c.opt.Store.Delete(c.opt.KeyFunc(r))
+}
+
+func (c *CachedResponse) matchVary(req *syshttp.Request) bool {
+	for name, val := range c.Vary {
+		if req.Header.Get(name) != val {
+			return false
+		}
+	}
+	return true
+}
+
+func cacheDirectives(header syshttp.Header) map[string]bool {
+	directives := make(map[string]bool)
+	for _, item := range strings.Split(header.Get("Cache-Control"), ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			directives[strings.SplitN(item, "=", 2)[0]] = true
+		}
+	}
+	if strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		directives["no-cache"] = true
+	}
+	return directives
+}
+
+func cacheDirectiveValue(header syshttp.Header, name string) (string, bool) {
+	for _, item := range strings.Split(header.Get("Cache-Control"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return strings.Trim(kv[1], `"`), true
+		}
+	}
+	return "", false
+}
+
+func hasAnyHeader(header syshttp.Header, names ...string) bool {
+	for _, name := range names {
+		if header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneRequestHeader(req *syshttp.Request) *syshttp.Request {
+	r := req.WithContext(req.Context())
+	r.Header = req.Header.Clone()
+	return r
+}
+
+type memoryCacheStore struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CachedResponse
+}
+
+// NewMemoryCacheStore is a LRU store of capacity entries
+func NewMemoryCacheStore(capacity int) CacheStore {
+	return &memoryCacheStore{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *memoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.ll.MoveToFront(elem)
+	/* copy so caller can update it */
+	entry := *elem.Value.(*memoryCacheItem).entry
+	entry.Header = syshttp.Header(entry.Header).Clone()
+	return &entry, true
+}
+
+func (s *memoryCacheStore) Set(key string, entry *CachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		elem.Value.(*memoryCacheItem).entry = entry
+		s.ll.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.ll.PushFront(&memoryCacheItem{key: key, entry: entry})
+	for s.capacity > 0 && s.ll.Len() > s.capacity {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryCacheItem).key)
+	}
+}
+
+func (s *memoryCacheStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.ll.Remove(elem)
+		delete(s.items, key)
+	}
+}
+
+type fileDBCacheStore struct {
+	kv *cli.BucketKV
+}
+
+// NewFileDBCacheStore store responses in bucket of db, so cache survives restart
+func NewFileDBCacheStore(db *cli.FileDB, bucket string) CacheStore {
+	return &fileDBCacheStore{kv: db.GetBucketKV(bucket)}
+}
+
+func (s *fileDBCacheStore) Get(key string) (*CachedResponse, bool) {
+	entry := new(CachedResponse)
+	if err := s.kv.Get(key, entry); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (s *fileDBCacheStore) Set(key string, entry *CachedResponse) {
+	s.kv.Put(key, entry)
+}
+
+func (s *fileDBCacheStore) Delete(key string) {
+	s.kv.Delete(key)
+}
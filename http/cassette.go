@@ -0,0 +1,215 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	syshttp "net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+)
+
+type CassetteMode int
+
+const (
+	// CassetteReplay serve recorded responses, unmatched requests fail
+	CassetteReplay CassetteMode = iota
+	// CassetteRecord send real requests and record them into cassette file
+	CassetteRecord
+)
+
+type CassetteOption struct {
+	Path          string
+	Mode          CassetteMode
+	MatchHeaders  []string           // optional, request headers must be equal besides method, url and body
+	RedactHeaders []string           // optional, headers recorded as [REDACTED] so they can not be matched, default Authorization, Proxy-Authorization, Cookie and Set-Cookie
+	Filter        func(*Interaction) // optional, modify interaction before it is saved, like removing tokens from body
+}
+
+// CassetteMissError is returned in replay mode when no interaction matches the request
+type CassetteMissError struct {
+	Method string
+	URL    string
+}
+
+func (e *CassetteMissError) Error() string {
+	return fmt.Sprintf("cassette: no recorded interaction for %s %s", e.Method, e.URL)
+}
+
+type Interaction struct {
+	Request  RecordedEntity `json:"request"`
+	Response RecordedEntity `json:"response"`
+}
+
+type RecordedEntity struct {
+	Method       string              `json:"method,omitempty"`
+	URL          string              `json:"url,omitempty"`
+	StatusCode   int                 `json:"status_code,omitempty"`
+	Status       string              `json:"status,omitempty"`
+	Header       map[string][]string `json:"header,omitempty"`
+	Body         string              `json:"body,omitempty"`
+	BodyEncoding string              `json:"body_encoding,omitempty"`
+}
+
+func newRecordedEntity(header syshttp.Header, body []byte, redactHeaders []string) RecordedEntity {
+	header = header.Clone()
+	for _, name := range redactHeaders {
+		name = syshttp.CanonicalHeaderKey(name)
+		if _, ok := header[name]; ok {
+			header[name] = []string{redacted}
+		}
+	}
+	e := RecordedEntity{Header: header}
+	if utf8.Valid(body) {
+		e.Body = string(body)
+	} else {
+		e.Body = base64.StdEncoding.EncodeToString(body)
+		e.BodyEncoding = "base64"
+	}
+	return e
+}
+
+func (e RecordedEntity) GetBody() []byte {
+	if e.BodyEncoding == "base64" {
+		data, _ := base64.StdEncoding.DecodeString(e.Body)
+		return data
+	}
+	return []byte(e.Body)
+}
+
+// Cassette record real http interactions into file and replay them in tests
+type Cassette struct {
+	mu           sync.Mutex
+	opt          CassetteOption
+	Interactions []*Interaction `json:"interactions"`
+	used         map[*Interaction]bool
+}
+
+// NewCassette load cassette file in replay mode, or create an empty one in record mode
+func NewCassette(opt CassetteOption) (*Cassette, error) {
+	if opt.RedactHeaders == nil {
+		opt.RedactHeaders = defaultRedactHeaders
+	}
+	c := &Cassette{opt: opt, used: make(map[*Interaction]bool)}
+	if opt.Mode == CassetteRecord {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(opt.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Middleware plug cassette next to transport, so the request is recorded or matched after all middlewares applied
+func (c *Cassette) Middleware() Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).Cassette = c
+			return next(req)
+		}
+	}
+}
+
+func (c *Cassette) isRecording() bool {
+	return c.opt.Mode == CassetteRecord
+}
+
+// Save write interactions into cassette file
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(c.opt.Path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.opt.Path, data, 0644)
+}
+
+func (c *Cassette) record(ctx context.Context, info *TransportInfo) {
+	if info.Err != nil {
+		return
+	}
+	it := &Interaction{
+		Request:  newRecordedEntity(info.Request.Header, info.Request.Body(), c.opt.RedactHeaders),
+		Response: newRecordedEntity(info.Response.Header, info.Response.Body(), c.opt.RedactHeaders),
+	}
+	it.Request.Method = info.Method
+	it.Request.URL = info.URL
+	it.Response.Status = info.Status
+	it.Response.StatusCode = statusCodeOf(info.Status)
+	if c.opt.Filter != nil {
+		c.opt.Filter(it)
+	}
+	c.mu.Lock()
+	c.Interactions = append(c.Interactions, it)
+	c.mu.Unlock()
+	if err := c.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "cassette: save %s: %v\n", c.opt.Path, err)
+	}
+}
+
+func (c *Cassette) replay(req *syshttp.Request) (*syshttp.Response, error) {
+	body, err := RepeatableReadRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	it := c.match(req, body)
+	if it == nil {
+		return nil, &CassetteMissError{Method: req.Method, URL: req.URL.String()}
+	}
+	resBody := it.Response.GetBody()
+	return &syshttp.Response{
+		Status:        it.Response.Status,
+		StatusCode:    it.Response.StatusCode,
+		Header:        syshttp.Header(it.Response.Header).Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(resBody)),
+		ContentLength: int64(len(resBody)),
+		Request:       req,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+	}, nil
+}
+
+// match return first unused interaction matched, or the last matched one if all used
+func (c *Cassette) match(req *syshttp.Request, body []byte) *Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var last *Interaction
+	for _, it := range c.Interactions {
+		if !c.matchOne(it, req, body) {
+			continue
+		}
+		if !c.used[it] {
+			c.used[it] = true
+			return it
+		}
+		last = it
+	}
+	return last
+}
+
+func (c *Cassette) matchOne(it *Interaction, req *syshttp.Request, body []byte) bool {
+	if it.Request.Method != req.Method || it.Request.URL != req.URL.String() {
+		return false
+	}
+	header := syshttp.Header(it.Request.Header)
+	for _, name := range c.opt.MatchHeaders {
+		if header.Get(name) != req.Header.Get(name) {
+			return false
+		}
+	}
+	return bytes.Equal(it.Request.GetBody(), body)
+}
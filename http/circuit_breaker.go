@@ -0,0 +1,198 @@
+package http
+
+import (
+	"fmt"
+	syshttp "net/http"
+	"sync"
+	"time"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrCircuitOpen is returned without sending request when circuit of Key is open
+type ErrCircuitOpen struct {
+	Key string
+}
+
+func (e *ErrCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open", e.Key)
+}
+
+type CircuitBreakerOption struct {
+	FailureRatio  float64                                              // optional, trip when failures/requests >= ratio, default 0.5
+	MinRequests   int                                                  // optional, requests needed in window before tripping, default 10
+	Window        time.Duration                                        // optional, counting window, default 10s
+	CoolDown      time.Duration                                        // optional, open duration before half-open, default 5s
+	HalfOpenMax   int                                                  // optional, probes allowed in half-open, default 1
+	KeyFunc       func(*syshttp.Request) string                        // optional, default by host
+	IsFailure     func(*syshttp.Response, error) bool                  // optional, default error or 5xx
+	OnStateChange func(key string, from CircuitState, to CircuitState) // optional
+}
+
+func (opt *CircuitBreakerOption) setDefaults() {
+	if opt.FailureRatio <= 0 {
+		opt.FailureRatio = 0.5
+	}
+	if opt.MinRequests <= 0 {
+		opt.MinRequests = 10
+	}
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.CoolDown <= 0 {
+		opt.CoolDown = 5 * time.Second
+	}
+	if opt.HalfOpenMax <= 0 {
+		opt.HalfOpenMax = 1
+	}
+	if opt.KeyFunc == nil {
+		opt.KeyFunc = func(req *syshttp.Request) string {
+			return req.URL.Host
+		}
+	}
+	if opt.IsFailure == nil {
+		opt.IsFailure = func(res *syshttp.Response, err error) bool {
+			return err != nil || (res != nil && res.StatusCode >= 500)
+		}
+	}
+}
+
+func CircuitBreakerMiddleware(opt CircuitBreakerOption) Middleware {
+	opt.setDefaults()
+	breakers := &circuitBreakerGroup{opt: &opt, breakers: make(map[string]*circuitBreaker)}
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			cb := breakers.Get(opt.KeyFunc(req))
+			generation, ok := cb.Allow()
+			if !ok {
+				return nil, &ErrCircuitOpen{Key: cb.key}
+			}
+			res, err := next(req)
+			cb.Done(generation, opt.IsFailure(res, err))
+			return res, err
+		}
+	}
+}
+
+type circuitBreakerGroup struct {
+	sync.Mutex
+	opt      *CircuitBreakerOption
+	breakers map[string]*circuitBreaker
+}
+
+func (g *circuitBreakerGroup) Get(key string) *circuitBreaker {
+	g.Lock()
+	defer g.Unlock()
+	cb, ok := g.breakers[key]
+	if !ok {
+		cb = &circuitBreaker{key: key, opt: g.opt, windowStart: time.Now()}
+		g.breakers[key] = cb
+	}
+	return cb
+}
+
+type circuitBreaker struct {
+	sync.Mutex
+	key         string
+	opt         *CircuitBreakerOption
+	state       CircuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	generation  uint64 // increased on every state change
+}
+
+// Allow return generation of current state, which is passed to Done
+func (cb *circuitBreaker) Allow() (uint64, bool) {
+	cb.Lock()
+	defer cb.Unlock()
+	now := time.Now()
+	switch cb.state {
+	case CircuitOpen:
+		if now.Sub(cb.openedAt) < cb.opt.CoolDown {
+			return cb.generation, false
+		}
+		cb.setState(CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.probes >= cb.opt.HalfOpenMax {
+			return cb.generation, false
+		}
+		cb.probes++
+	default:
+		if now.Sub(cb.windowStart) >= cb.opt.Window {
+			cb.resetWindow(now)
+		}
+	}
+	return cb.generation, true
+}
+
+// Done ignore requests allowed before last state change, so a slow request allowed in closed state is not taken as a probe
+func (cb *circuitBreaker) Done(generation uint64, failed bool) {
+	cb.Lock()
+	defer cb.Unlock()
+	if generation != cb.generation {
+		return
+	}
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed {
+			cb.open()
+		} else if cb.probes--; cb.probes == 0 {
+			cb.resetWindow(time.Now())
+			cb.setState(CircuitClosed)
+		}
+	case CircuitClosed:
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.opt.MinRequests && float64(cb.failures)/float64(cb.requests) >= cb.opt.FailureRatio {
+			cb.open()
+		}
+	}
+}
+
+func (cb *circuitBreaker) open() {
+	cb.openedAt = time.Now()
+	cb.probes = 0
+	cb.setState(CircuitOpen)
+}
+
+func (cb *circuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) setState(state CircuitState) {
+	if cb.state == state {
+		return
+	}
+	from := cb.state
+	cb.state = state
+	cb.generation++
+	if cb.opt.OnStateChange != nil {
+		cb.opt.OnStateChange(cb.key, from, state)
+	}
+}
@@ -79,6 +79,22 @@ func (client *clientImpl) SetRetry(opt RetryOption) Client {
 	return client
 }
 
+func (client *clientImpl) SetCircuitBreaker(opt CircuitBreakerOption) Client {
+	return client.AddMiddleware(CircuitBreakerMiddleware(opt))
+}
+
+func (client *clientImpl) SetRateLimit(opt RateLimitOption) Client {
+	return client.AddMiddleware(RateLimitMiddleware(opt))
+}
+
+func (client *clientImpl) SetFailover(opt FailoverOption) Client {
+	return client.AddMiddleware(FailoverMiddleware(opt))
+}
+
+func (client *clientImpl) SetTokenSource(src TokenSource) Client {
+	return client.AddMiddleware(BearerTokenMiddleware(src))
+}
+
 func (client *clientImpl) SetHeader(name, val string) Client {
 	return client.SetHeaders(map[string]string{name: val})
 }
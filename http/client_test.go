@@ -3,18 +3,28 @@ package http
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/qjpcpu/common.v2/cli"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -133,7 +143,7 @@ func interceptStdout() func() []byte {
 
 func TestDebug(t *testing.T) {
 	stdout := interceptStdout()
-	server := NewMockServer()
+	server := NewMockServer().Handle("/echo", Echo)
 	defer server.ServeBackground()()
 
 	suite := assert.New(t)
@@ -648,3 +658,1174 @@ func TestStatusCode(t *testing.T) {
 	suite.NotNil(res1.Err)
 	suite.Equal(`500 Internal Server Error BODY`, res1.Err.Error())
 }
+
+func TestCircuitBreaker(t *testing.T) {
+	suite := assert.New(t)
+	var val int
+	fail := true
+	server := NewMockServer().Handle("/cb", func(w http.ResponseWriter, req *http.Request) {
+		val++
+		if fail {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	defer server.ServeBackground()()
+
+	var states []string
+	client := NewClient().SetCircuitBreaker(CircuitBreakerOption{
+		MinRequests: 2,
+		CoolDown:    20 * time.Millisecond,
+		OnStateChange: func(key string, from, to CircuitState) {
+			states = append(states, to.String())
+		},
+	})
+	suite.Nil(client.Get(nil, server.URLPrefix+"/cb").Err)
+	suite.Nil(client.Get(nil, server.URLPrefix+"/cb").Err)
+	res := client.Get(nil, server.URLPrefix+"/cb")
+	var cerr *ErrCircuitOpen
+	suite.True(errors.As(res.Err, &cerr))
+	suite.Equal(2, val)
+
+	time.Sleep(30 * time.Millisecond)
+	fail = false
+	res = client.Get(nil, server.URLPrefix+"/cb")
+	suite.Nil(res.Err)
+	suite.Equal("OK", string(res.MustGetBody()))
+	suite.Equal(3, val)
+	suite.Equal([]string{"open", "half-open", "closed"}, states)
+}
+
+func TestCircuitBreakerStaleDone(t *testing.T) {
+	suite := assert.New(t)
+	opt := CircuitBreakerOption{MinRequests: 1, CoolDown: time.Millisecond}
+	opt.setDefaults()
+	cb := &circuitBreaker{key: "k", opt: &opt, windowStart: time.Now()}
+	slow, ok := cb.Allow()
+	suite.True(ok)
+	failed, _ := cb.Allow()
+	cb.Done(failed, true)
+	suite.Equal(CircuitOpen, cb.state)
+
+	time.Sleep(2 * time.Millisecond)
+	probe, ok := cb.Allow()
+	suite.True(ok)
+	suite.Equal(CircuitHalfOpen, cb.state)
+	/* slow request of closed state finishes during half-open */
+	cb.Done(slow, false)
+	suite.Equal(CircuitHalfOpen, cb.state)
+	suite.Equal(1, cb.probes)
+	cb.Done(probe, false)
+	suite.Equal(CircuitClosed, cb.state)
+}
+
+func TestRateLimit(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer().Handle("/rl", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer server.ServeBackground()()
+
+	client := NewClient().SetRateLimit(RateLimitOption{Rate: 100, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		suite.Nil(client.Get(nil, server.URLPrefix+"/rl").Err)
+	}
+	suite.True(time.Since(start) >= 35*time.Millisecond)
+
+	/* only the blocked request is bounded by a short deadline */
+	client = NewClient().SetRateLimit(RateLimitOption{Rate: 0.001, Burst: 1})
+	suite.Nil(client.Get(context.Background(), server.URLPrefix+"/rl").Err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	suite.Equal(context.DeadlineExceeded, client.Get(ctx, server.URLPrefix+"/rl").Err)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	suite := assert.New(t)
+	var running, maxRunning int32
+	server := NewMockServer().Handle("/cl", func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		w.Write([]byte("OK"))
+	})
+	defer server.ServeBackground()()
+
+	client := NewClient().SetRateLimit(RateLimitOption{MaxInFlight: 2, PerHost: true})
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Get(nil, server.URLPrefix+"/cl")
+		}()
+	}
+	wg.Wait()
+	suite.Equal(int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestRetryAfter(t *testing.T) {
+	suite := assert.New(t)
+	var val int
+	server := NewMockServer().Handle("/429", func(w http.ResponseWriter, req *http.Request) {
+		val++
+		if val < 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	defer server.ServeBackground()()
+
+	client := NewClient().SetRetry(RetryOption{RetryMax: 2, RetryWaitMin: time.Hour, RetryWaitMax: time.Hour})
+	res := client.Get(nil, server.URLPrefix+"/429")
+	suite.Nil(res.Err)
+	suite.Equal("OK", string(res.MustGetBody()))
+	suite.Equal(2, val)
+
+	/* too long to wait, response is returned */
+	server.Handle("/busy", func(w http.ResponseWriter, req *http.Request) {
+		val++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	start := time.Now()
+	res = NewClient().SetRetry(RetryOption{RetryMax: 2, RetryWaitMax: time.Second}).Get(nil, server.URLPrefix+"/busy")
+	suite.Nil(res.Err)
+	suite.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	suite.Equal(3, val)
+	suite.True(time.Since(start) < time.Second)
+
+	wait, ok := retryAfter(&http.Response{Header: http.Header{"Retry-After": []string{"3"}}})
+	suite.True(ok)
+	suite.Equal(3*time.Second, wait)
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	wait, ok = retryAfter(&http.Response{Header: http.Header{"Retry-After": []string{at}}})
+	suite.True(ok)
+	suite.True(wait > 50*time.Second)
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	suite := assert.New(t)
+	var val int
+	server := NewMockServer().Handle("/503", func(w http.ResponseWriter, req *http.Request) {
+		val++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.ServeBackground()()
+	client := NewClient().SetRetry(RetryOption{RetryMax: 2, Backoff: ConstantBackoff(time.Millisecond)})
+
+	res := client.Get(nil, server.URLPrefix+"/503")
+	suite.Nil(res.Err)
+	suite.Equal(3, val)
+
+	val = 0
+	client.Post(nil, server.URLPrefix+"/503", []byte("x"))
+	suite.Equal(1, val)
+
+	val = 0
+	client.Post(nil, server.URLPrefix+"/503", []byte("x"), WithIdempotent())
+	suite.Equal(3, val)
+
+	val = 0
+	client.Post(nil, server.URLPrefix+"/503", []byte("x"), WithHeader("Idempotency-Key", "abc"))
+	suite.Equal(3, val)
+}
+
+func TestRetryBudget(t *testing.T) {
+	suite := assert.New(t)
+	var val int
+	client := NewClient().SetMock(func(*http.Request) (*http.Response, error) {
+		val++
+		return nil, errors.New("connection reset by peer")
+	})
+	start := time.Now()
+	res := client.Get(nil, "http://sss", WithRetry(RetryOption{
+		RetryMax:   10,
+		Backoff:    ConstantBackoff(10 * time.Millisecond),
+		MaxElapsed: 25 * time.Millisecond,
+	}))
+	suite.NotNil(res.Err)
+	suite.Equal(3, val)
+	suite.True(time.Since(start) < 25*time.Millisecond)
+}
+
+func TestBackoff(t *testing.T) {
+	suite := assert.New(t)
+	exp := ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	suite.Equal(10*time.Millisecond, exp(0, 0))
+	suite.Equal(20*time.Millisecond, exp(1, 0))
+	suite.Equal(40*time.Millisecond, exp(2, 0))
+	suite.Equal(50*time.Millisecond, exp(3, 0))
+
+	dj := DecorrelatedJitterBackoff(10*time.Millisecond, 50*time.Millisecond)
+	var prev time.Duration
+	for i := 0; i < 20; i++ {
+		prev = dj(i, prev)
+		suite.True(prev >= 10*time.Millisecond && prev <= 50*time.Millisecond)
+	}
+	suite.Equal(time.Second, ConstantBackoff(time.Second)(5, 0))
+}
+
+func TestCassette(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer().Handle("/echo", Echo)
+	stop := server.ServeBackground()
+	path := filepath.Join(os.TempDir(), "cassette-test.json")
+	defer os.Remove(path)
+
+	/* record */
+	cassette, err := NewCassette(CassetteOption{Path: path, Mode: CassetteRecord, Filter: func(it *Interaction) {
+		it.Request.Header["X-Api-Key"] = []string{"-"}
+	}})
+	suite.Nil(err)
+	client := NewClient().AddMiddleware(cassette.Middleware())
+	res := client.PostJSON(nil, server.URLPrefix+"/echo?a=1", map[string]int{"x": 1}, WithHeader("Authorization", "Bearer secret"), WithHeader("X-Api-Key", "key"))
+	suite.Nil(res.Err)
+	recorded := res.MustGetBody()
+	stop()
+	saved, err := NewCassette(CassetteOption{Path: path})
+	suite.Nil(err)
+	suite.Equal([]string{"[REDACTED]"}, saved.Interactions[0].Request.Header["Authorization"])
+	suite.Equal([]string{"-"}, saved.Interactions[0].Request.Header["X-Api-Key"])
+
+	/* replay without network */
+	cassette, err = NewCassette(CassetteOption{Path: path, MatchHeaders: []string{"Content-Type"}})
+	suite.Nil(err)
+	suite.Len(cassette.Interactions, 1)
+	client = NewClient().AddMiddleware(cassette.Middleware())
+	res = client.PostJSON(nil, server.URLPrefix+"/echo?a=1", map[string]int{"x": 1})
+	suite.Nil(res.Err)
+	suite.Equal(200, res.StatusCode)
+	suite.Equal(string(recorded), string(res.MustGetBody()))
+
+	res = client.PostJSON(nil, server.URLPrefix+"/echo?a=1", map[string]int{"x": 2})
+	var miss *CassetteMissError
+	suite.True(errors.As(res.Err, &miss))
+	suite.Equal("POST", miss.Method)
+
+	res = client.Post(nil, server.URLPrefix+"/echo?a=1", []byte(`{"x":1}`))
+	suite.True(errors.As(res.Err, &miss))
+}
+
+func TestMockServerStub(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer()
+	server.On("GET", "/users/:id").ReplyFunc(func(req *http.Request, params map[string]string) (int, interface{}) {
+		return 200, map[string]string{"id": params["id"]}
+	})
+	server.On("GET", "/users/:id").WithHeader("Token", "admin").Reply(200, "ADMIN")
+	server.On("POST", "/slow").Delay(5*time.Millisecond).Reply(201, []byte("CREATED"))
+	server.On("GET", "/reset").Fault(FaultConnectionReset)
+	server.On("GET", "/trickle").Fault(FaultSlowBody, time.Millisecond).Reply(200, "abc")
+	defer server.ServeBackground()()
+	client := NewClient()
+
+	user := make(map[string]string)
+	res := client.Get(nil, server.URLPrefix+"/users/42")
+	suite.Nil(res.Err)
+	suite.Nil(res.Unmarshal(&user))
+	suite.Equal("42", user["id"])
+	suite.Equal("application/json", res.Header.Get("Content-Type"))
+
+	res = client.Get(nil, server.URLPrefix+"/users/1", WithHeader("Token", "admin"))
+	suite.Equal("ADMIN", string(res.MustGetBody()))
+
+	res = client.Post(nil, server.URLPrefix+"/slow", []byte("payload"))
+	suite.Equal(201, res.StatusCode)
+	suite.Equal("payload", string(server.Calls("POST", "/slow")[0].Body))
+
+	suite.NotNil(client.Get(nil, server.URLPrefix+"/reset").Err)
+
+	res = client.Get(nil, server.URLPrefix+"/trickle")
+	suite.Equal("abc", string(res.MustGetBody()))
+
+	res = client.Get(nil, server.URLPrefix+"/missing")
+	suite.Equal(404, res.StatusCode)
+
+	suite.True(server.AssertCalled(t, "GET", "/users/:id", 2))
+	suite.True(server.AssertNotCalled(t, "DELETE", "/users/:id"))
+	mt := &mockT{}
+	suite.False(server.AssertCalled(mt, "PUT", "/users/:id"))
+	suite.False(server.AssertNotCalled(mt, "GET", "/users/42"))
+	suite.Len(mt.errors, 2)
+}
+
+type mockT struct {
+	errors []string
+}
+
+func (m *mockT) Errorf(format string, args ...interface{}) {
+	m.errors = append(m.errors, fmt.Sprintf(format, args...))
+}
+
+func TestStreamLines(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer().Handle("/ndjson", func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "{\"n\":%d}\r\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}).Handle("/array", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(` [{"n":0}, {"n":1},{"n":2}]`))
+	})
+	defer server.ServeBackground()()
+
+	/* timeout only limits response header in stream mode */
+	client := NewClient().SetTimeout(30 * time.Millisecond)
+	var lines []string
+	err := client.Get(context.Background(), server.URLPrefix+"/ndjson", WithStream()).Lines(func(line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	})
+	suite.NoError(err)
+	suite.Equal([]string{`{"n":0}`, `{"n":1}`, `{"n":2}`}, lines)
+
+	type item struct {
+		N int `json:"n"`
+	}
+	for _, path := range []string{"/ndjson", "/array"} {
+		var list []int
+		err = client.Get(context.Background(), server.URLPrefix+path, WithStream()).DecodeStream(func(it item) {
+			list = append(list, it.N)
+		})
+		suite.NoError(err, path)
+		suite.Equal([]int{0, 1, 2}, list, path)
+	}
+
+	stop := errors.New("stop")
+	var count int
+	err = client.Get(context.Background(), server.URLPrefix+"/array").DecodeStream(func(it *item) error {
+		if count++; it.N == 1 {
+			return stop
+		}
+		return nil
+	})
+	suite.Equal(stop, err)
+	suite.Equal(2, count)
+	suite.Error(client.Get(context.Background(), server.URLPrefix+"/array").DecodeStream(func() {}))
+}
+
+func TestSSE(t *testing.T) {
+	suite := assert.New(t)
+	var lastIDs []string
+	var mu sync.Mutex
+	server := NewMockServer().Handle("/events", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		lastIDs = append(lastIDs, req.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		if req.Header.Get("Last-Event-ID") == "" {
+			fmt.Fprint(w, ": hello\nretry: 10\n\nid: 1\nevent: greet\ndata: hello\ndata: world\n\n")
+			return
+		}
+		fmt.Fprint(w, "id: 2\ndata: again\n\n")
+	}).Handle("/gone", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer server.ServeBackground()()
+
+	client := NewClient()
+	var events []SSEEvent
+	stop := errors.New("stop")
+	err := client.SSE(context.Background(), server.URLPrefix+"/events", SSEOption{
+		OnEvent: func(ev *SSEEvent) error {
+			events = append(events, *ev)
+			if len(events) == 2 {
+				return stop
+			}
+			return nil
+		},
+	})
+	suite.Equal(stop, err)
+	suite.Equal([]SSEEvent{
+		{ID: "1", Event: "greet", Data: "hello\nworld", Retry: 10 * time.Millisecond},
+		{ID: "2", Event: "message", Data: "again", Retry: 10 * time.Millisecond},
+	}, events)
+	suite.Equal([]string{"", "1"}, lastIDs)
+
+	suite.NoError(client.SSE(context.Background(), server.URLPrefix+"/gone", SSEOption{OnEvent: func(*SSEEvent) error { return nil }}))
+	suite.Error(client.SSE(context.Background(), server.URLPrefix+"/events", SSEOption{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.SSE(ctx, server.URLPrefix+"/events", SSEOption{
+		LastEventID:   "1",
+		ReconnectWait: 5 * time.Millisecond,
+		OnEvent:       func(*SSEEvent) error { return nil },
+	})
+	suite.Equal(context.DeadlineExceeded, err)
+}
+
+func TestDownloadFile(t *testing.T) {
+	suite := assert.New(t)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha256.Sum256(content)
+	md := md5.Sum(content)
+	var mu sync.Mutex
+	var ranges []string
+	var served int64
+	server := NewMockServer().Handle("/file", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md[:])+`"`)
+		http.ServeContent(w, req, "file", time.Unix(1600000000, 0), &countingReadSeeker{ReadSeeker: bytes.NewReader(content), n: &served})
+	}).Handle("/plain", func(w http.ResponseWriter, req *http.Request) {
+		w.Write(content)
+	})
+	defer server.ServeBackground()()
+
+	dir, err := ioutil.TempDir("", "download")
+	suite.NoError(err)
+	defer os.RemoveAll(dir)
+	client := NewClient()
+
+	/* parallel segments */
+	var last, total int64
+	file := filepath.Join(dir, "a")
+	err = client.DownloadFile(context.Background(), server.URLPrefix+"/file", file, DownloadOption{
+		Segments:   4,
+		MinSegment: 1024,
+		SHA256:     hex.EncodeToString(sum[:]),
+		VerifyETag: true,
+		OnProgress: func(done, size int64) { last, total = done, size },
+	})
+	suite.NoError(err)
+	data, _ := ioutil.ReadFile(file)
+	suite.Equal(content, data)
+	suite.Equal(int64(len(content)), last)
+	suite.Equal(int64(len(content)), total)
+	suite.Len(ranges, 5)
+	_, err = os.Stat(file + ".part.json")
+	suite.True(os.IsNotExist(err))
+
+	/* interrupted download resumes */
+	file = filepath.Join(dir, "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	err = client.DownloadFile(ctx, server.URLPrefix+"/file", file, DownloadOption{
+		OnProgress: func(done, size int64) {
+			if done >= int64(len(content))/2 {
+				cancel()
+			}
+		},
+	})
+	suite.Error(err)
+	_, err = os.Stat(file + ".part.json")
+	suite.NoError(err)
+	atomic.StoreInt64(&served, 0)
+	err = client.DownloadFile(context.Background(), server.URLPrefix+"/file", file, DownloadOption{SHA256: hex.EncodeToString(sum[:])})
+	suite.NoError(err)
+	data, _ = ioutil.ReadFile(file)
+	suite.Equal(content, data)
+	suite.True(atomic.LoadInt64(&served) < int64(len(content)))
+
+	/* server without range support */
+	file = filepath.Join(dir, "c")
+	err = client.DownloadFile(context.Background(), server.URLPrefix+"/plain", file, DownloadOption{SHA256: "00"})
+	var checksumErr *ChecksumError
+	suite.True(errors.As(err, &checksumErr))
+	suite.Equal("sha256", checksumErr.Algorithm)
+	_, err = os.Stat(file + ".part")
+	suite.True(os.IsNotExist(err))
+	suite.NoError(client.DownloadFile(context.Background(), server.URLPrefix+"/plain", file, DownloadOption{}))
+	data, _ = ioutil.ReadFile(file)
+	suite.Equal(content, data)
+}
+
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n *int64
+}
+
+func (r *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+func TestPostMultipart(t *testing.T) {
+	suite := assert.New(t)
+	var attempts int32
+	var contentLength int64
+	server := NewMockServer().Handle("/upload", func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		contentLength = req.ContentLength
+		reader, err := req.MultipartReader()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result := make(map[string]string)
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := ioutil.ReadAll(part)
+			result[part.FormName()] = fmt.Sprintf("%s|%s|%s|%x", part.FileName(), part.Header.Get("Content-Type"), part.Header.Get("X-Tag"), data)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	defer server.ServeBackground()()
+
+	dir, err := ioutil.TempDir("", "multipart")
+	suite.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data.bin")
+	ioutil.WriteFile(file, []byte{0xff, 0x00, 0xfe}, 0644)
+
+	var logged string
+	client := NewClient().SetRetry(RetryOption{RetryMax: 1, RetryWaitMin: time.Millisecond, RetryWaitMax: time.Millisecond}).
+		SetDebug(func(ctx context.Context, info *TransportInfo) { logged = string(info.Request.Body()) })
+	var result map[string]string
+	err = client.PostMultipart(context.Background(), server.URLPrefix+"/upload", []Part{
+		FieldPart("name", "jack"),
+		FilePart("file", file).WithPartHeader("X-Tag", "t1"),
+		ReaderPart("note", "note.txt", strings.NewReader("hello")).WithContentType("text/plain"),
+	}, WithIdempotent()).Unmarshal(&result)
+	suite.NoError(err)
+	suite.Equal(int32(2), atomic.LoadInt32(&attempts))
+	suite.Equal(map[string]string{
+		"name": "|||6a61636b",
+		"file": "data.bin|application/octet-stream|t1|ff00fe",
+		"note": "note.txt|text/plain||68656c6c6f",
+	}, result)
+	suite.Equal(int64(-1), contentLength)
+	suite.Contains(logged, "name: jack")
+	suite.Contains(logged, "file: <file data.bin, 3 bytes elided>")
+	suite.NotContains(logged, "\xff")
+
+	/* known sizes make content length */
+	atomic.StoreInt32(&attempts, 1)
+	res := client.PostMultipart(context.Background(), server.URLPrefix+"/upload", []Part{FieldPart("name", "jack"), FilePart("file", file)})
+	suite.NoError(res.Err)
+	suite.True(contentLength > 0)
+
+	/* reader can not be reopened */
+	atomic.StoreInt32(&attempts, 0)
+	res = client.PostMultipart(context.Background(), server.URLPrefix+"/upload", []Part{ReaderPart("r", "r", bytes.NewBufferString("x"))}, WithIdempotent())
+	suite.Error(res.Err)
+}
+
+func TestRequestBuilder(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer()
+	server.On("GET", "/users/:id").ReplyFunc(func(req *http.Request, params map[string]string) (int, interface{}) {
+		if params["id"] == "404" {
+			return 404, map[string]interface{}{"code": 40401, "message": "user not found"}
+		}
+		return 200, map[string]interface{}{"id": params["id"], "query": req.URL.RawQuery, "token": req.Header.Get("Token")}
+	})
+	server.On("POST", "/users").ReplyFunc(func(req *http.Request, _ map[string]string) (int, interface{}) {
+		data, _ := ioutil.ReadAll(req.Body)
+		return 201, map[string]interface{}{"body": string(data), "type": req.Header.Get("Content-Type")}
+	})
+	server.On("GET", "/bad").Reply(502, "bad gateway")
+	defer server.ServeBackground()()
+
+	type filter struct {
+		Name   string   `query:"name"`
+		Tags   []string `query:"tag"`
+		Page   int      `query:"page,omitempty"`
+		Hidden string   `query:"-"`
+		Limit  *int
+	}
+	type apiError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	client := NewClient()
+	var user map[string]string
+	limit := 10
+	err := client.NewRequest("GET", server.URLPrefix+"/users/{id}").
+		PathParam("id", 42).
+		Query("v", 1).
+		QueryStruct(filter{Name: "a b", Tags: []string{"x", "y"}, Hidden: "h", Limit: &limit}).
+		Header("Token", "t").
+		Do(context.Background()).
+		Decode(&user, nil)
+	suite.NoError(err)
+	suite.Equal(map[string]string{"id": "42", "query": "Limit=10&name=a+b&tag=x&tag=y&v=1", "token": "t"}, user)
+
+	var apiErr apiError
+	err = client.NewRequest("GET", server.URLPrefix+"/users/{id}").PathParam("id", 404).Do(context.Background()).Decode(&user, &apiErr)
+	var httpErr *HTTPError
+	suite.True(errors.As(err, &httpErr))
+	suite.Equal(404, httpErr.StatusCode)
+	suite.Equal(&apiError{Code: 40401, Message: "user not found"}, httpErr.Decoded)
+	suite.Equal(40401, apiErr.Code)
+
+	err = client.NewRequest("GET", server.URLPrefix+"/bad").Do(context.Background()).Decode(nil, &apiErr)
+	suite.True(errors.As(err, &httpErr))
+	suite.Nil(httpErr.Decoded)
+	suite.Equal("bad gateway", string(httpErr.Body))
+
+	var created map[string]string
+	err = client.NewRequest("POST", server.URLPrefix+"/users").JSON(map[string]int{"age": 1}).Do(context.Background()).Decode(&created, nil)
+	suite.NoError(err)
+	suite.Equal(map[string]string{"body": `{"age":1}`, "type": "application/json; charset=utf-8"}, created)
+
+	suite.Error(client.NewRequest("GET", server.URLPrefix+"/users/1").QueryStruct(1).Do(context.Background()).Err)
+	client = NewClient().AddMiddleware(MiddlewareSetAllowedStatusCode(http.StatusOK))
+	suite.True(errors.As(client.Get(context.Background(), server.URLPrefix+"/bad").Decode(nil, nil), &httpErr))
+}
+
+func TestStructuredLogger(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer()
+	server.On("POST", "/login").ReplyHeader("Set-Cookie", "sid=secret").Reply(200, map[string]string{"token": "tk-123", "name": "jack"})
+	server.On("GET", "/image").ReplyHeader("Content-Type", "image/png").Reply(200, []byte{0x89, 'P', 'N', 'G'})
+	server.On("GET", "/long").Reply(404, strings.Repeat("a", 100))
+	defer server.ServeBackground()()
+
+	buf := new(bytes.Buffer)
+	client := NewClient().SetDebug(NewLogger(LoggerOption{
+		Writer:         buf,
+		Format:         LogJSON,
+		HeaderPatterns: []*regexp.Regexp{regexp.MustCompile(`(?i)^x-api-`)},
+		RedactFields:   []string{"password", "token"},
+		BodyPatterns:   []*regexp.Regexp{regexp.MustCompile(`\d{11}`)},
+		MaxBodySize:    30,
+	}))
+	res := client.PostJSON(context.Background(), server.URLPrefix+"/login?token=abc&v=1", map[string]string{"password": "p", "mobile": "13800000000"},
+		WithHeaders(map[string]string{"Authorization": "Bearer x", "X-Api-Key": "k"}))
+	suite.NoError(res.Err)
+	var entry map[string]interface{}
+	suite.NoError(json.Unmarshal(buf.Bytes(), &entry))
+	suite.Equal("info", entry["level"])
+	suite.Contains(entry["url"], "token=%5BREDACTED%5D")
+	reqEntity := entry["request"].(map[string]interface{})
+	suite.Equal("[REDACTED]", reqEntity["header"].(map[string]interface{})["Authorization"])
+	suite.Equal("[REDACTED]", reqEntity["header"].(map[string]interface{})["X-Api-Key"])
+	suite.Equal(`{"mobile":"[REDACTED]","passwo...(17 bytes truncated)`, reqEntity["body"])
+	resEntity := entry["response"].(map[string]interface{})
+	suite.Equal("[REDACTED]", resEntity["header"].(map[string]interface{})["Set-Cookie"])
+	suite.NotContains(buf.String(), "tk-123")
+	suite.NotContains(buf.String(), "sid=secret")
+
+	/* text format, binary body and level gating */
+	buf.Reset()
+	client = NewClient().SetDebug(NewLogger(LoggerOption{Writer: buf, RedactFields: []string{"password", "mobile"}}))
+	client.PostJSON(context.Background(), server.URLPrefix+"/login", map[string]string{"password": "p", "mobile": "13800000000"})
+	suite.Contains(buf.String(), "[INFO] POST")
+	suite.Contains(buf.String(), `{"mobile":"[REDACTED]","password":"[REDACTED]"}`)
+	buf.Reset()
+	client.Get(context.Background(), server.URLPrefix+"/image")
+	suite.Contains(buf.String(), "<binary 4 bytes>")
+
+	buf.Reset()
+	client = NewClient().SetDebug(NewLogger(LoggerOption{Writer: buf, MinLevel: LogWarn}))
+	client.Get(context.Background(), server.URLPrefix+"/image")
+	suite.Empty(buf.String())
+	client.Get(context.Background(), server.URLPrefix+"/long")
+	suite.Contains(buf.String(), "[WARN] GET")
+}
+
+func TestHedge(t *testing.T) {
+	suite := assert.New(t)
+	var calls int32
+	server := NewMockServer().Handle("/item", func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%d:%s", n, body)
+	})
+	defer server.ServeBackground()()
+
+	client := NewClient().AddMiddleware(HedgeMiddleware(HedgeOption{Delay: 20 * time.Millisecond}))
+	start := time.Now()
+	res := client.Put(context.Background(), server.URLPrefix+"/item", []byte("x"))
+	suite.NoError(res.Err)
+	suite.Equal("2:x", string(res.MustGetBody()))
+	suite.True(time.Since(start) < 500*time.Millisecond)
+
+	/* non idempotent request is not hedged */
+	atomic.StoreInt32(&calls, 1)
+	res = client.Post(context.Background(), server.URLPrefix+"/item", []byte("y"))
+	suite.Equal("2:y", string(res.MustGetBody()))
+	suite.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	/* stream body stays readable */
+	atomic.StoreInt32(&calls, 0)
+	var lines []string
+	err := client.Get(context.Background(), server.URLPrefix+"/item", WithStream()).Lines(func(line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	})
+	suite.NoError(err)
+	suite.Equal([]string{"2:"}, lines)
+
+	/* attempts can not write into the same body writer */
+	server.Handle("/file", func(w http.ResponseWriter, req *http.Request) {
+		ch := []byte{"bc"[(atomic.AddInt32(&calls, 1)-1)%2]}
+		for i := 0; i < 4; i++ {
+			w.Write(bytes.Repeat(ch, 4))
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	atomic.StoreInt32(&calls, 0)
+	buf := new(bytes.Buffer)
+	suite.NoError(client.Download(context.Background(), server.URLPrefix+"/file", buf))
+	suite.Equal(strings.Repeat("b", 16), buf.String())
+	suite.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestFailover(t *testing.T) {
+	suite := assert.New(t)
+	server := NewMockServer()
+	server.On("GET", "/api/users/:id").ReplyFunc(func(req *http.Request, params map[string]string) (int, interface{}) {
+		return 200, params["id"] + "?" + req.URL.RawQuery
+	})
+	defer server.ServeBackground()()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.NoError(err)
+	deadURL := "http://" + ln.Addr().String() + "/api"
+	ln.Close()
+
+	var failovers int32
+	client := NewClient().SetFailover(FailoverOption{
+		BaseURLs: []string{deadURL, server.URLPrefix + "/api/"},
+		ShouldFailover: func(req *http.Request, res *http.Response, err error) bool {
+			if err != nil {
+				atomic.AddInt32(&failovers, 1)
+			}
+			return err != nil
+		},
+	})
+	res := client.Get(context.Background(), "/users/1?v=1")
+	suite.NoError(res.Err)
+	suite.Equal("1?v=1", string(res.MustGetBody()))
+	suite.Equal(int32(1), atomic.LoadInt32(&failovers))
+
+	/* stick to healthy endpoint, absolute url of base host is rewritten too */
+	res = client.Get(context.Background(), deadURL+"/users/2")
+	suite.NoError(res.Err)
+	suite.Equal("2?", string(res.MustGetBody()))
+	suite.Equal(int32(1), atomic.LoadInt32(&failovers))
+	server.AssertCalled(t, "GET", "/api/users/:id", 2)
+
+	/* multipart body is streamed to every endpoint, not buffered */
+	server.On("POST", "/api/upload").ReplyFunc(func(req *http.Request, params map[string]string) (int, interface{}) {
+		req.ParseMultipartForm(1 << 20)
+		return 200, req.FormValue("name")
+	})
+	client = NewClient().SetFailover(FailoverOption{BaseURLs: []string{deadURL, server.URLPrefix + "/api"}})
+	var streamed []bool
+	res = client.PostMultipart(context.Background(), "/upload", []Part{FieldPart("name", "gopher")}, WithMiddleware(func(next Endpoint) Endpoint {
+		return func(req *http.Request) (*http.Response, error) {
+			_, ok := req.Body.(streamBody)
+			streamed = append(streamed, ok)
+			return next(req)
+		}
+	}))
+	suite.NoError(res.Err)
+	suite.Equal("gopher", string(res.MustGetBody()))
+	suite.Equal([]bool{true, true}, streamed)
+
+	client = NewClient().SetFailover(FailoverOption{BaseURLs: []string{deadURL}})
+	suite.Error(client.Get(context.Background(), "/users/1").Err)
+}
+
+func TestFailoverRelativePath(t *testing.T) {
+	suite := assert.New(t)
+	base, _ := url.Parse("http://a.com/api")
+	for uri, expect := range map[string]string{
+		"http://a.com/api":      "",
+		"http://a.com/api/v2/x": "/v2/x",
+		"/users":                "/users",
+		"http://a.com/apiv2/x":  "-",
+		"http://b.com/api/v2/x": "-",
+	} {
+		u, _ := url.Parse(uri)
+		path, ok := relativePath(u, []*url.URL{base})
+		if expect == "-" {
+			suite.False(ok, uri)
+		} else {
+			suite.True(ok, uri)
+			suite.Equal(expect, path, uri)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	suite := assert.New(t)
+	var calls, revalidated int32
+	server := NewMockServer().Handle("/fresh", func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if req.Method == "GET" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprintf(w, "fresh-%d", n)
+	}).Handle("/etag", func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&revalidated, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("etag-body"))
+	})
+	defer server.ServeBackground()()
+
+	client := NewClient().AddMiddleware(CacheMiddleware(CacheOption{}))
+	get := func(path string, opts ...Option) string {
+		res := client.Get(context.Background(), server.URLPrefix+path, opts...)
+		suite.NoError(res.Err)
+		suite.Equal(200, res.StatusCode)
+		return string(res.MustGetBody())
+	}
+	suite.Equal("fresh-1", get("/fresh"))
+	suite.Equal("fresh-1", get("/fresh"))
+	suite.Equal(int32(1), atomic.LoadInt32(&calls))
+	suite.Equal("fresh-2", get("/fresh", WithCacheRefresh()))
+	suite.Equal("fresh-3", get("/fresh", WithCacheBypass()))
+	suite.Equal("fresh-2", get("/fresh"))
+
+	/* unsafe method invalidates */
+	suite.NoError(client.Post(context.Background(), server.URLPrefix+"/fresh", nil).Err)
+	suite.Equal("fresh-5", get("/fresh"))
+
+	/* revalidate by etag */
+	atomic.StoreInt32(&calls, 0)
+	suite.Equal("etag-body", get("/etag"))
+	suite.Equal("etag-body", get("/etag"))
+	suite.Equal(int32(2), atomic.LoadInt32(&calls))
+	suite.Equal(int32(1), atomic.LoadInt32(&revalidated))
+
+	/* lru evicts oldest */
+	store := NewMemoryCacheStore(1)
+	store.Set("a", &CachedResponse{})
+	store.Set("b", &CachedResponse{})
+	_, ok := store.Get("a")
+	suite.False(ok)
+	_, ok = store.Get("b")
+	suite.True(ok)
+
+	/* disk store survives new client */
+	dir, err := ioutil.TempDir("", "cache")
+	suite.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := cli.NewFileDB(dir)
+	suite.NoError(err)
+	defer db.Close()
+	atomic.StoreInt32(&calls, 0)
+	client = NewClient().AddMiddleware(CacheMiddleware(CacheOption{Store: NewFileDBCacheStore(db, "http")}))
+	suite.Equal("fresh-1", get("/fresh"))
+	client = NewClient().AddMiddleware(CacheMiddleware(CacheOption{Store: NewFileDBCacheStore(db, "http")}))
+	suite.Equal("fresh-1", get("/fresh"))
+	suite.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestBearerToken(t *testing.T) {
+	suite := assert.New(t)
+	var issued, expiresIn int32 = 0, 3600
+	var mu sync.Mutex
+	var grants []string
+	valid := "tk-1"
+	server := NewMockServer().Handle("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"bad secret"}`))
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		mu.Lock()
+		grants = append(grants, req.PostForm.Get("grant_type")+":"+req.PostForm.Get("refresh_token"))
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  fmt.Sprintf("tk-%d", n),
+			"token_type":    "bearer",
+			"expires_in":    atomic.LoadInt32(&expiresIn),
+			"refresh_token": fmt.Sprintf("rt-%d", n),
+		})
+	}).Handle("/api", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ok := req.Header.Get("Authorization") == "Bearer "+valid
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	defer server.ServeBackground()()
+
+	opt := OAuth2Option{TokenURL: server.URLPrefix + "/token", ClientID: "id", ClientSecret: "secret"}
+	client := NewClient().SetTokenSource(NewOAuth2TokenSource(nil, opt))
+	res := client.Post(context.Background(), server.URLPrefix+"/api", []byte("a"))
+	suite.Equal("a", string(res.MustGetBody()))
+
+	/* token revoked, refresh once on 401 and resend body */
+	mu.Lock()
+	valid = "tk-2"
+	mu.Unlock()
+	res = client.Post(context.Background(), server.URLPrefix+"/api", []byte("b"))
+	suite.Equal(200, res.StatusCode)
+	suite.Equal("b", string(res.MustGetBody()))
+	suite.Equal([]string{"client_credentials:", "refresh_token:rt-1"}, grants)
+
+	/* concurrent requests share one refresh */
+	atomic.StoreInt32(&issued, 2)
+	mu.Lock()
+	valid = "tk-3"
+	mu.Unlock()
+	client = NewClient().SetTokenSource(NewOAuth2TokenSource(nil, opt))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			suite.Equal(200, client.Get(context.Background(), server.URLPrefix+"/api").StatusCode)
+		}()
+	}
+	wg.Wait()
+	suite.Equal(int32(3), atomic.LoadInt32(&issued))
+
+	/* leeway is clamped to half lifetime, so token shorter than leeway is still reused */
+	atomic.StoreInt32(&expiresIn, 30)
+	src := ReuseTokenSource(NewOAuth2TokenSource(nil, opt), time.Minute)
+	tok1, err := src.Token(context.Background())
+	suite.NoError(err)
+	tok2, err := src.Token(context.Background())
+	suite.NoError(err)
+	suite.Equal(tok1.AccessToken, tok2.AccessToken)
+
+	/* token expiring within leeway is refreshed ahead */
+	var fetched int32
+	src = ReuseTokenSource(TokenSourceFunc(func(context.Context) (*Token, error) {
+		n := atomic.AddInt32(&fetched, 1)
+		return &Token{AccessToken: fmt.Sprint(n), Expiry: time.Now().Add(100 * time.Millisecond)}, nil
+	}), time.Minute)
+	tok1, _ = src.Token(context.Background())
+	tok2, _ = src.Token(context.Background())
+	suite.Equal(tok1, tok2)
+	time.Sleep(60 * time.Millisecond)
+	tok2, _ = src.Token(context.Background())
+	suite.Equal("2", tok2.AccessToken)
+
+	opt.ClientSecret = "wrong"
+	res = NewClient().SetTokenSource(NewOAuth2TokenSource(nil, opt)).Get(context.Background(), server.URLPrefix+"/api")
+	var httpErr *HTTPError
+	suite.True(errors.As(res.Err, &httpErr))
+	suite.Equal(&OAuth2Error{Code: "invalid_client", Description: "bad secret"}, httpErr.Decoded)
+}
+
+func TestSigV4Signer(t *testing.T) {
+	suite := assert.New(t)
+	signer := NewSigV4Signer(SigV4Option{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+		Now:       func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	})
+	/* cases from aws signature v4 test suite */
+	cases := map[string]string{
+		"https://example.amazonaws.com/":                             "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"https://example.amazonaws.com/?Param2=value2&Param1=value1": "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	}
+	for uri, signature := range cases {
+		req, _ := http.NewRequest("GET", uri, nil)
+		suite.NoError(signer.Sign(req, nil))
+		suite.Equal("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature="+signature, req.Header.Get("Authorization"), uri)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	suite := assert.New(t)
+	var attempts int32
+	var mu sync.Mutex
+	var auths []string
+	secret := []byte("secret")
+	server := NewMockServer().Handle("/sign", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		sum := sha256.Sum256(body)
+		canonical := strings.Join([]string{
+			"POST",
+			"/sign",
+			"a=1&b=x%20y",
+			"content-type:text/plain\nhost:" + req.Host + "\nx-content-sha256:" + hex.EncodeToString(sum[:]) + "\nx-date:" + req.Header.Get("X-Date") + "\n",
+			"content-type;host;x-content-sha256;x-date",
+			hex.EncodeToString(sum[:]),
+		}, "\n")
+		mac := hmacSHA256(secret, canonical)
+		expect := "HMAC-SHA256 Credential=k1, SignedHeaders=content-type;host;x-content-sha256;x-date, Signature=" + hex.EncodeToString(mac)
+		mu.Lock()
+		auths = append(auths, req.Header.Get("Authorization"))
+		mu.Unlock()
+		if req.Header.Get("Authorization") != expect {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	})
+	defer server.ServeBackground()()
+
+	var tick int64
+	client := NewClient().
+		SetRetry(RetryOption{RetryMax: 1, RetryWaitMin: time.Millisecond, RetryWaitMax: time.Millisecond}).
+		AddMiddleware(SigningMiddleware(NewHMACSigner(HMACSignerOption{
+			KeyID:  "k1",
+			Secret: secret,
+			Now:    func() time.Time { return time.Unix(1600000000+atomic.AddInt64(&tick, 1), 0) },
+		})))
+	res := client.Post(context.Background(), server.URLPrefix+"/sign?b=x+y&a=1", []byte("payload"), WithHeader("Content-Type", "text/plain"), WithIdempotent())
+	suite.Equal(200, res.StatusCode)
+	suite.Equal("payload", string(res.MustGetBody()))
+	suite.Len(auths, 2)
+	suite.NotEqual(auths[0], auths[1])
+
+	/* stream body is not hashed as empty */
+	req, _ := http.NewRequest("POST", server.URLPrefix+"/upload", nil)
+	req.Body = newMultipartBody([]Part{FieldPart("a", "1")}, "boundary")
+	suite.NoError(NewHMACSigner(HMACSignerOption{KeyID: "k1", Secret: secret}).Sign(req, nil))
+	suite.Equal("UNSIGNED-PAYLOAD", req.Header.Get("X-Content-Sha256"))
+}
+
+func TestTrace(t *testing.T) {
+	suite := assert.New(t)
+	var mu sync.Mutex
+	var parents, states []string
+	server := NewMockServer().Handle("/trace", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		parents = append(parents, req.Header.Get("traceparent"))
+		states = append(states, req.Header.Get("tracestate"))
+		mu.Unlock()
+		w.Write([]byte("hello"))
+	})
+	defer server.ServeBackground()()
+
+	var spans []*Span
+	var infos []*TransportInfo
+	client := NewClient().
+		AddMiddleware(TraceMiddleware(TraceOption{Exporter: func(span *Span) {
+			mu.Lock()
+			defer mu.Unlock()
+			spans = append(spans, span)
+		}})).
+		SetDebug(func(ctx context.Context, info *TransportInfo) {
+			infos = append(infos, info)
+		})
+
+	/* new trace */
+	res := client.Get(context.Background(), server.URLPrefix+"/trace")
+	suite.Equal("hello", string(res.MustGetBody()))
+	suite.Len(spans, 1)
+	sc, ok := ParseTraceParent(parents[0], "")
+	suite.True(ok)
+	suite.Equal(spans[0].SpanContext.TraceID, sc.TraceID)
+	suite.Equal(spans[0].SpanContext.SpanID, sc.SpanID)
+	suite.True(sc.Sampled)
+	suite.Empty(spans[0].ParentSpanID)
+	suite.Equal(200, spans[0].StatusCode)
+	suite.True(spans[0].Timing.TTFB > 0)
+	suite.True(spans[0].Timing.Connect > 0)
+	suite.NotNil(infos[0].Timing)
+	suite.Equal(spans[0].Timing, *infos[0].Timing)
+
+	/* child of context */
+	parent, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "congo=t61rcWkgMzE")
+	suite.True(ok)
+	res = client.Get(ContextWithSpanContext(context.Background(), parent), server.URLPrefix+"/trace")
+	suite.NoError(res.Err)
+	suite.Len(spans, 2)
+	suite.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[1].SpanContext.TraceID)
+	suite.Equal("00f067aa0ba902b7", spans[1].ParentSpanID)
+	suite.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-"+spans[1].SpanContext.SpanID+"-00", parents[1])
+	suite.Equal("congo=t61rcWkgMzE", states[1])
+	suite.True(infos[1].Timing.Reused)
+
+	/* failed request is exported too */
+	res = client.Get(context.Background(), "http://127.0.0.1:1/trace")
+	suite.Error(res.Err)
+	suite.Len(spans, 3)
+	suite.Error(spans[2].Err)
+
+	/* retries are siblings of one trace, reused request does not carry span of last call */
+	var attempts int32
+	server.Handle("/flaky", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		parents = append(parents, req.Header.Get("traceparent"))
+		mu.Unlock()
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	spans, parents = nil, nil
+	client.SetRetry(RetryOption{RetryMax: 2, RetryWaitMin: time.Millisecond, RetryWaitMax: time.Millisecond})
+	req, _ := http.NewRequest("GET", server.URLPrefix+"/flaky", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res = client.DoRequest(req)
+	suite.Equal(200, res.StatusCode)
+	suite.Len(spans, 3)
+	for i, span := range spans {
+		suite.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID)
+		suite.Equal("00f067aa0ba902b7", span.ParentSpanID)
+		suite.Equal(span.SpanContext.TraceParent(), parents[i])
+	}
+	suite.NotEqual(spans[0].SpanContext.SpanID, spans[1].SpanContext.SpanID)
+	suite.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", req.Header.Get("traceparent"))
+
+	_, ok = ParseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01", "")
+	suite.False(ok)
+
+	/* hedged attempts of a new trace share one trace id */
+	var hedged int32
+	server.Handle("/slow", func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&hedged, 1) == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+			}
+		}
+	})
+	spans = nil
+	client = NewClient().
+		AddMiddleware(TraceMiddleware(TraceOption{Exporter: func(span *Span) {
+			mu.Lock()
+			defer mu.Unlock()
+			spans = append(spans, span)
+		}})).
+		AddMiddleware(HedgeMiddleware(HedgeOption{Delay: 20 * time.Millisecond}))
+	res = client.Get(context.Background(), server.URLPrefix+"/slow")
+	suite.NoError(res.Err)
+	suite.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(spans) == 2
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	suite.Equal(spans[0].SpanContext.TraceID, spans[1].SpanContext.TraceID)
+	suite.NotEqual(spans[0].SpanContext.SpanID, spans[1].SpanContext.SpanID)
+	mu.Unlock()
+}
@@ -14,12 +14,23 @@ const (
 )
 
 type gValue struct {
-	BodySaver   io.Writer
-	Timeout     time.Duration
-	Mock        Endpoint
-	Debugger    HTTPLogger
-	RetryOption *RetryOption
-	RetryHooks  []RetryHook
+	BodySaver    io.Writer
+	Timeout      time.Duration
+	Mock         Endpoint
+	Debugger     HTTPLogger
+	RetryOption  *RetryOption
+	RetryHooks   []RetryHook
+	RateLimiters []*rateLimiter
+	Idempotent   bool
+	Cassette     *Cassette
+	Stream       bool
+	Cache        *httpCache
+	CacheMode    cacheMode
+	Signers      []Signer
+	Tracer       *tracer
+	Timing       *traceCollector
+	TraceParent  *SpanContext
+	Hedge        *HedgeOption
 }
 
 func getValue(req *syshttp.Request) *gValue {
@@ -51,3 +62,29 @@ func setValue(req *syshttp.Request, v *gValue) *syshttp.Request {
 func (v *gValue) AddRetryHook(hook RetryHook) {
 	v.RetryHooks = append(v.RetryHooks, hook)
 }
+
+func (v *gValue) AddRateLimiter(rl *rateLimiter) {
+	for _, item := range v.RateLimiters {
+		if item == rl {
+			return
+		}
+	}
+	v.RateLimiters = append(v.RateLimiters, rl)
+}
+
+// clone copy value for a concurrent attempt, so middlewares of attempts do not share slices
+func (v *gValue) clone() *gValue {
+	cp := *v
+	cp.RetryHooks = append([]RetryHook(nil), v.RetryHooks...)
+	cp.RateLimiters = append([]*rateLimiter(nil), v.RateLimiters...)
+	cp.Signers = append([]Signer(nil), v.Signers...)
+	if v.RetryOption != nil {
+		opt := *v.RetryOption
+		cp.RetryOption = &opt
+	}
+	return &cp
+}
+
+func (v *gValue) AddSigner(s Signer) {
+	v.Signers = append(v.Signers, s)
+}
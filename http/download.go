@@ -0,0 +1,393 @@
+package http
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	syshttp "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DownloadOption struct {
+	Segments   int                           // optional, parallel range requests for large file, default 1
+	MinSegment int64                         // optional, min bytes of a segment, default 1MB
+	SHA256     string                        // optional, expected hex sha256 of file
+	VerifyETag bool                          // optional, treat ETag of 32 hex chars as md5 of file like S3 does
+	OnProgress func(downloaded, total int64) // optional, total is -1 if unknown, cli.ByteBar.Update fits
+}
+
+// ChecksumError is returned when downloaded file not matches expected checksum, partial file is removed
+type ChecksumError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch, expect %s, actual %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+// DownloadFile download uri into path. Data is written into path.part and progress into path.part.json,
+// so an interrupted download resumes by range requests if the resource is not changed
+func (client *clientImpl) DownloadFile(ctx context.Context, uri, path string, opt DownloadOption, opts ...Option) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opt.MinSegment <= 0 {
+		opt.MinSegment = 1 << 20
+	}
+	partFile, stateFile := path+".part", path+".part.json"
+	opts = append(opts, WithStream())
+
+	/* probe size and range support by the first byte */
+	res := client.Get(ctx, uri, append(opts, WithHeader("Range", "bytes=0-0"))...)
+	if res.Err == nil && res.StatusCode == syshttp.StatusRequestedRangeNotSatisfiable {
+		res.Body.Close()
+		res = client.Get(ctx, uri, opts...)
+	}
+	if res.Err != nil {
+		return res.Err
+	}
+	total, ranged := parseContentRange(res.Header.Get("Content-Range"))
+	etag := res.Header.Get("ETag")
+	switch {
+	case res.StatusCode == syshttp.StatusPartialContent && ranged:
+		res.Body.Close()
+		state := newDownloadState(res.Header, total)
+		err := client.downloadRanges(ctx, uri, partFile, stateFile, state, opt, opts)
+		if err != nil {
+			return err
+		}
+	case res.StatusCode == syshttp.StatusPartialContent:
+		/* total size unknown */
+		res.Body.Close()
+		res = client.Get(ctx, uri, opts...)
+		if res.Err != nil {
+			return res.Err
+		}
+		fallthrough
+	case res.StatusCode == syshttp.StatusOK:
+		os.Remove(stateFile)
+		err := downloadWhole(res, partFile, newDownloadProgress(res.ContentLength, opt.OnProgress))
+		if err != nil {
+			return err
+		}
+	default:
+		res.Body.Close()
+		return fmt.Errorf("download %s: %s", uri, res.Status)
+	}
+
+	if err := verifyDownload(partFile, etag, opt); err != nil {
+		os.Remove(partFile)
+		os.Remove(stateFile)
+		return err
+	}
+	if err := os.Rename(partFile, path); err != nil {
+		return err
+	}
+	os.Remove(stateFile)
+	return nil
+}
+
+func downloadWhole(res *Response, partFile string, progress *downloadProgress) error {
+	defer res.Body.Close()
+	f, err := os.Create(partFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			progress.Add(int64(n))
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (client *clientImpl) downloadRanges(ctx context.Context, uri, partFile, stateFile string, state *downloadState, opt DownloadOption, opts []Option) error {
+	/* resume if resource not changed */
+	if prev := loadDownloadState(stateFile); prev != nil && prev.sameResource(state) {
+		if fi, err := os.Stat(partFile); err == nil && fi.Size() == state.Size {
+			state = prev
+		}
+	}
+	if state.Segments == nil {
+		state.split(opt.Segments, opt.MinSegment)
+	}
+	f, err := os.OpenFile(partFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(state.Size); err != nil {
+		return err
+	}
+	progress := newDownloadProgress(state.Size, opt.OnProgress)
+	progress.Add(state.downloaded())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	/* persist progress periodically, so a crashed download can resume */
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				state.Save(stateFile)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, seg := range state.Segments {
+		wg.Add(1)
+		go func(seg *downloadSegment) {
+			defer wg.Done()
+			if err := client.downloadSegment(ctx, uri, f, state, seg, progress, opts); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(seg)
+	}
+	wg.Wait()
+	cancel()
+	<-saved
+	if firstErr != nil {
+		state.Save(stateFile)
+		return firstErr
+	}
+	return nil
+}
+
+func (client *clientImpl) downloadSegment(ctx context.Context, uri string, f *os.File, state *downloadState, seg *downloadSegment, progress *downloadProgress, opts []Option) error {
+	from := seg.Start + atomic.LoadInt64(&seg.Done)
+	if from >= seg.End {
+		return nil
+	}
+	header := map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", from, seg.End-1)}
+	if validator := state.validator(); validator != "" {
+		header["If-Range"] = validator
+	}
+	res := client.Get(ctx, uri, append(opts, WithHeaders(header))...)
+	if res.Err != nil {
+		return res.Err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != syshttp.StatusPartialContent {
+		return fmt.Errorf("download %s: expect partial content, got %s, resource may be changed", uri, res.Status)
+	}
+	buf := make([]byte, 32*1024)
+	for from < seg.End {
+		/* body may be buffered already */
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if from+int64(n) > seg.End {
+				n = int(seg.End - from)
+			}
+			if _, werr := f.WriteAt(buf[:n], from); werr != nil {
+				return werr
+			}
+			from += int64(n)
+			atomic.AddInt64(&seg.Done, int64(n))
+			progress.Add(int64(n))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if from < seg.End {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func verifyDownload(partFile, etag string, opt DownloadOption) error {
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	checkETag := opt.VerifyETag && len(etag) == 32 && isHex(etag)
+	if opt.SHA256 == "" && !checkETag {
+		return nil
+	}
+	f, err := os.Open(partFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sha, md := sha256.New(), md5.New()
+	if _, err = io.Copy(io.MultiWriter(sha, md), f); err != nil {
+		return err
+	}
+	if err = compareChecksum("sha256", opt.SHA256, sha); err != nil {
+		return err
+	}
+	if checkETag {
+		return compareChecksum("etag", etag, md)
+	}
+	return nil
+}
+
+func compareChecksum(algorithm, expected string, h hash.Hash) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return &ChecksumError{Algorithm: algorithm, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// parseContentRange parse total size from header like bytes 0-0/1234
+func parseContentRange(val string) (int64, bool) {
+	i := strings.LastIndexByte(val, '/')
+	if !strings.HasPrefix(val, "bytes ") || i < 0 {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(val[i+1:], 10, 64)
+	return total, err == nil
+}
+
+type downloadProgress struct {
+	sync.Mutex
+	done  int64
+	total int64
+	fn    func(int64, int64)
+}
+
+func newDownloadProgress(total int64, fn func(int64, int64)) *downloadProgress {
+	return &downloadProgress{total: total, fn: fn}
+}
+
+func (p *downloadProgress) Add(n int64) {
+	if p.fn == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.done += n
+	p.fn(p.done, p.total)
+}
+
+type downloadState struct {
+	ETag         string             `json:"etag,omitempty"`
+	LastModified string             `json:"last_modified,omitempty"`
+	Size         int64              `json:"size"`
+	Segments     []*downloadSegment `json:"segments"`
+}
+
+type downloadSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func newDownloadState(header syshttp.Header, total int64) *downloadState {
+	return &downloadState{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Size:         total,
+	}
+}
+
+func loadDownloadState(file string) *downloadState {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	state := new(downloadState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil
+	}
+	return state
+}
+
+// Save write a snapshot, segments are being written concurrently
+func (s *downloadState) Save(file string) error {
+	snapshot := *s
+	snapshot.Segments = make([]*downloadSegment, len(s.Segments))
+	for i, seg := range s.Segments {
+		snapshot.Segments[i] = &downloadSegment{Start: seg.Start, End: seg.End, Done: atomic.LoadInt64(&seg.Done)}
+	}
+	data, err := json.Marshal(&snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func (s *downloadState) sameResource(other *downloadState) bool {
+	if s.Size != other.Size || (s.ETag == "" && s.LastModified == "") {
+		return false
+	}
+	return s.ETag == other.ETag && s.LastModified == other.LastModified
+}
+
+// validator return strong validator for If-Range
+func (s *downloadState) validator() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+func (s *downloadState) split(n int, minSize int64) {
+	if max := s.Size / minSize; int64(n) > max {
+		n = int(max)
+	}
+	if n < 1 {
+		n = 1
+	}
+	size := s.Size / int64(n)
+	for i := 0; i < n; i++ {
+		seg := &downloadSegment{Start: int64(i) * size, End: int64(i+1) * size}
+		if i == n-1 {
+			seg.End = s.Size
+		}
+		s.Segments = append(s.Segments, seg)
+	}
+}
+
+func (s *downloadState) downloaded() int64 {
+	var n int64
+	for _, seg := range s.Segments {
+		n += atomic.LoadInt64(&seg.Done)
+	}
+	return n
+}
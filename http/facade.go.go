@@ -13,18 +13,26 @@ type Client interface {
 	SetMock(fn Endpoint) Client
 	SetDebug(w HTTPLogger) Client
 	SetRetry(opt RetryOption) Client
+	SetCircuitBreaker(opt CircuitBreakerOption) Client
+	SetRateLimit(opt RateLimitOption) Client
+	SetFailover(opt FailoverOption) Client
+	SetTokenSource(src TokenSource) Client
 	SetHeader(name, val string) Client
 	SetHeaders(hder map[string]string) Client
 	MakeDoer(opts ...Option) Doer
+	NewRequest(method, uri string) *RequestBuilder
 	AddMiddleware(m ...Middleware) Client
 	AddBeforeHook(hook func(*http.Request)) Client
 	AddAfterHook(hook func(*http.Response)) Client
 	DoRequest(req *http.Request, opts ...Option) *Response
 	Do(ctx context.Context, method string, uri string, body io.Reader, opts ...Option) *Response
 	Download(ctx context.Context, uri string, w io.Writer, opts ...Option) error
+	DownloadFile(ctx context.Context, uri, path string, opt DownloadOption, opts ...Option) error
 	Get(ctx context.Context, uri string, opts ...Option) *Response
 	Post(ctx context.Context, urlstr string, data []byte, opts ...Option) *Response
 	Put(ctx context.Context, urlstr string, data []byte, opts ...Option) *Response
 	PostForm(ctx context.Context, urlstr string, data map[string]interface{}, opts ...Option) *Response
 	PostJSON(ctx context.Context, urlstr string, data interface{}, opts ...Option) *Response
+	PostMultipart(ctx context.Context, urlstr string, parts []Part, opts ...Option) *Response
+	SSE(ctx context.Context, uri string, opt SSEOption, opts ...Option) error
 }
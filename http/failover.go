@@ -0,0 +1,92 @@
+package http
+
+import (
+	"errors"
+	syshttp "net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+type FailoverOption struct {
+	BaseURLs       []string                                                          // endpoints like http://10.0.0.1:8080/api
+	ShouldFailover func(req *syshttp.Request, res *syshttp.Response, err error) bool // optional, default on errors except HTTPError and cancelled context
+}
+
+// FailoverMiddleware send relative requests, or requests to one of base urls, to current endpoint,
+// and rotate to next endpoint on connection errors. Every endpoint is tried at most once per request
+func FailoverMiddleware(opt FailoverOption) Middleware {
+	var bases []*url.URL
+	for _, s := range opt.BaseURLs {
+		u, err := url.Parse(strings.TrimSuffix(s, "/"))
+		if err != nil {
+			panic(err)
+		}
+		bases = append(bases, u)
+	}
+	if opt.ShouldFailover == nil {
+		opt.ShouldFailover = func(req *syshttp.Request, res *syshttp.Response, err error) bool {
+			var httpErr *HTTPError
+			return err != nil && req.Context().Err() == nil && !errors.As(err, &httpErr)
+		}
+	}
+	var current uint32
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (res *syshttp.Response, err error) {
+			if len(bases) == 0 {
+				return next(req)
+			}
+			path, ok := relativePath(req.URL, bases)
+			if !ok {
+				return next(req)
+			}
+			start := atomic.LoadUint32(&current)
+			for i := 0; i < len(bases); i++ {
+				idx := (start + uint32(i)) % uint32(len(bases))
+				/* body of previous attempt is consumed */
+				if err := prepareAttemptBody(req, i); err != nil {
+					return nil, err
+				}
+				res, err = next(withBaseURL(req, bases[idx], path))
+				if !opt.ShouldFailover(req, res, err) {
+					return
+				}
+				if res != nil && res.Body != nil {
+					res.Body.Close()
+				}
+				/* rotate unless others did */
+				atomic.CompareAndSwapUint32(&current, idx, (idx+1)%uint32(len(bases)))
+			}
+			return
+		}
+	}
+}
+
+// relativePath return path relative to base url, for url without host or with host of a base
+func relativePath(u *url.URL, bases []*url.URL) (string, bool) {
+	if u.Host == "" {
+		return u.Path, true
+	}
+	for _, base := range bases {
+		if u.Host == base.Host && hasPathPrefix(u.Path, base.Path) {
+			return strings.TrimPrefix(u.Path, base.Path), true
+		}
+	}
+	return "", false
+}
+
+// hasPathPrefix match whole segments, so /api is not a prefix of /apiv2
+func hasPathPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func withBaseURL(req *syshttp.Request, base *url.URL, path string) *syshttp.Request {
+	r := req.WithContext(req.Context())
+	u := *req.URL
+	u.Scheme, u.Host, u.Path, u.RawPath = base.Scheme, base.Host, base.Path+"/"+strings.TrimPrefix(path, "/"), ""
+	r.URL = &u
+	if req.Host == "" || req.Host == req.URL.Host {
+		r.Host = base.Host
+	}
+	return r
+}
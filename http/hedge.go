@@ -0,0 +1,158 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	syshttp "net/http"
+	"time"
+)
+
+type HedgeOption struct {
+	Delay       time.Duration                       // send a duplicate request when no successful response after delay
+	MaxHedges   int                                 // optional, max duplicate requests, default 1
+	ShouldHedge func(*syshttp.Request) bool         // optional, default idempotent requests only
+	IsSuccess   func(*syshttp.Response, error) bool // optional, default no error and status below 500
+}
+
+// HedgeMiddleware send duplicate requests after delay and return the first successful response, others are cancelled.
+// A failed attempt starts the next duplicate immediately. Every attempt retries on its own,
+// requests with body writer like Download are not hedged since attempts can not share the writer
+func HedgeMiddleware(opt HedgeOption) Middleware {
+	if opt.MaxHedges <= 0 {
+		opt.MaxHedges = 1
+	}
+	if opt.ShouldHedge == nil {
+		opt.ShouldHedge = isIdempotent
+	}
+	if opt.IsSuccess == nil {
+		opt.IsSuccess = func(res *syshttp.Response, err error) bool {
+			return err == nil && res != nil && res.StatusCode < 500
+		}
+	}
+	h := &opt
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).Hedge = h
+			return next(req)
+		}
+	}
+}
+
+func middlewareHedge(opt *HedgeOption) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			if !opt.ShouldHedge(req) {
+				return next(req)
+			}
+			return hedge(req, next, *opt)
+		}
+	}
+}
+
+type hedgeResult struct {
+	res    *syshttp.Response
+	err    error
+	req    *syshttp.Request
+	idx    int
+	cancel context.CancelFunc
+}
+
+func hedge(req *syshttp.Request, next Endpoint, opt HedgeOption) (*syshttp.Response, error) {
+	var body []byte
+	sb, isStream := req.Body.(streamBody)
+	if req.Body != nil && !isStream {
+		var err error
+		if body, err = RepeatableReadRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	parent := req.Context()
+	results := make(chan *hedgeResult, opt.MaxHedges+1)
+	var cancels []context.CancelFunc
+	launch := func() {
+		ctx, cancel := context.WithCancel(parent)
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		r := req.WithContext(ctx)
+		r.Header = req.Header.Clone()
+		/* every attempt owns its header, body and context value */
+		if isStream {
+			r.Body = sb.Rewind()
+		} else if req.Body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if gv := getValue(req); gv != nil {
+			r = setValue(r, gv.clone())
+		}
+		go func() {
+			res, err := next(r)
+			results <- &hedgeResult{res: res, err: err, req: r, idx: idx, cancel: cancel}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(opt.Delay)
+	defer timer.Stop()
+	pending := 1
+	var last *hedgeResult
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if opt.IsSuccess(r.res, r.err) {
+				if last != nil {
+					closeHedge(last)
+				}
+				abandonHedges(results, pending, cancels, r.idx)
+				return finishHedge(r)
+			}
+			if last != nil {
+				closeHedge(last)
+			}
+			last = r
+			if len(cancels) <= opt.MaxHedges {
+				launch()
+				pending++
+			}
+		case <-timer.C:
+			if len(cancels) <= opt.MaxHedges {
+				launch()
+				pending++
+				timer.Reset(opt.Delay)
+			}
+		}
+	}
+	return finishHedge(last)
+}
+
+// finishHedge keep context of stream body until it is closed
+func finishHedge(r *hedgeResult) (*syshttp.Response, error) {
+	if gv := getValue(r.req); gv != nil && gv.Stream && r.res != nil && r.res.Body != nil {
+		r.res.Body = &cancelOnClose{ReadCloser: r.res.Body, cancel: r.cancel}
+	} else {
+		r.cancel()
+	}
+	return r.res, r.err
+}
+
+func closeHedge(r *hedgeResult) {
+	if r.res != nil && r.res.Body != nil {
+		r.res.Body.Close()
+	}
+	r.cancel()
+}
+
+// abandonHedges cancel other attempts and release their responses in background
+func abandonHedges(results chan *hedgeResult, pending int, cancels []context.CancelFunc, winner int) {
+	for i, cancel := range cancels {
+		if i != winner {
+			cancel()
+		}
+	}
+	go func() {
+		for i := 0; i < pending; i++ {
+			closeHedge(<-results)
+		}
+	}()
+}
@@ -0,0 +1,315 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	syshttp "net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type LogFormat int
+
+const (
+	LogText LogFormat = iota
+	// LogJSON write one json object per line
+	LogJSON
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+const redacted = "[REDACTED]"
+
+// defaultRedactHeaders is redacted from logs and cassettes by default
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+type LoggerOption struct {
+	Writer         io.Writer                     // optional, default os.Stdout
+	Format         LogFormat                     // optional, default LogText
+	RedactHeaders  []string                      // optional, case insensitive header names, default Authorization, Proxy-Authorization, Cookie and Set-Cookie
+	HeaderPatterns []*regexp.Regexp              // optional, redact headers whose name matches
+	RedactFields   []string                      // optional, redact values of json body fields, form fields and query params
+	BodyPatterns   []*regexp.Regexp              // optional, redact body text matches
+	MaxBodySize    int                           // optional, truncate body, default 4096, negative means omit body
+	MinLevel       LogLevel                      // optional, skip entries below it
+	SlowThreshold  time.Duration                 // optional, slower requests are warn
+	LevelFunc      func(*TransportInfo) LogLevel // optional, default error on failure or 5xx, warn on 4xx or slow, otherwise info
+}
+
+// NewLogger make HTTPLogger with redaction, truncation and level gating
+//
+//	client.SetDebug(NewLogger(LoggerOption{Format: LogJSON, RedactFields: []string{"password"}, MinLevel: LogWarn}))
+func NewLogger(opt LoggerOption) HTTPLogger {
+	l := newStructuredLogger(opt)
+	return l.Log
+}
+
+type structuredLogger struct {
+	mu      sync.Mutex
+	opt     LoggerOption
+	headers map[string]bool
+	fields  map[string]bool
+}
+
+func newStructuredLogger(opt LoggerOption) *structuredLogger {
+	if opt.Writer == nil {
+		opt.Writer = os.Stdout
+	}
+	if opt.RedactHeaders == nil {
+		opt.RedactHeaders = defaultRedactHeaders
+	}
+	if opt.MaxBodySize == 0 {
+		opt.MaxBodySize = 4096
+	}
+	if opt.LevelFunc == nil {
+		opt.LevelFunc = func(info *TransportInfo) LogLevel {
+			code := statusCodeOf(info.Status)
+			switch {
+			case info.Err != nil || code >= 500:
+				return LogError
+			case code >= 400 || (opt.SlowThreshold > 0 && info.Cost >= opt.SlowThreshold):
+				return LogWarn
+			}
+			return LogInfo
+		}
+	}
+	l := &structuredLogger{opt: opt, headers: make(map[string]bool), fields: make(map[string]bool)}
+	for _, name := range opt.RedactHeaders {
+		l.headers[syshttp.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range opt.RedactFields {
+		l.fields[name] = true
+	}
+	return l
+}
+
+type logEntity struct {
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+}
+
+type logEntry struct {
+	Time     string     `json:"time"`
+	Level    string     `json:"level"`
+	Method   string     `json:"method"`
+	URL      string     `json:"url"`
+	Status   string     `json:"status"`
+	CostMS   float64    `json:"cost_ms"`
+	Error    string     `json:"error,omitempty"`
+	Request  *logEntity `json:"request,omitempty"`
+	Response *logEntity `json:"response,omitempty"`
+}
+
+func (l *structuredLogger) Log(ctx context.Context, info *TransportInfo) {
+	level := l.opt.LevelFunc(info)
+	if level < l.opt.MinLevel {
+		return
+	}
+	entry := &logEntry{
+		Time:   info.StartAt.Format("2006-01-02 15:04:05.000"),
+		Level:  level.String(),
+		Method: info.Method,
+		URL:    l.redactURL(info.URL),
+		Status: info.Status,
+		CostMS: float64(info.Cost) / float64(time.Millisecond),
+	}
+	if info.Request != nil {
+		entry.Request = l.entity(info.Request)
+	}
+	if info.Err != nil {
+		entry.Error = info.Err.Error()
+	} else if info.Response != nil {
+		entry.Response = l.entity(info.Response)
+	}
+
+	buf := new(bytes.Buffer)
+	if l.opt.Format == LogJSON {
+		json.NewEncoder(buf).Encode(entry)
+	} else {
+		l.writeText(buf, entry)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.opt.Writer.Write(buf.Bytes())
+}
+
+func (l *structuredLogger) writeText(w io.Writer, entry *logEntry) {
+	fmt.Fprintf(w, "%s [%s] %s %s %s cost:%.3fms\n", entry.Time, strings.ToUpper(entry.Level), entry.Method, entry.URL, entry.Status, entry.CostMS)
+	writeEntity := func(name string, e *logEntity) {
+		if e == nil {
+			return
+		}
+		fmt.Fprintf(w, "[%s-Headers]\n", name)
+		for _, k := range sortedKeys(e.Header) {
+			fmt.Fprintf(w, "  %s:%s\n", k, e.Header[k])
+		}
+		fmt.Fprintf(w, "[%s-Body]\n", name)
+		if e.Body != "" {
+			fmt.Fprintln(w, e.Body)
+		}
+	}
+	writeEntity("Request", entry.Request)
+	if entry.Error != "" {
+		fmt.Fprintf(w, "[Response Error]:%s\n", entry.Error)
+	}
+	writeEntity("Response", entry.Response)
+}
+
+func (l *structuredLogger) entity(e *TransportEntity) *logEntity {
+	le := &logEntity{Header: make(map[string]string)}
+	for k := range e.Header {
+		if l.isSensitiveHeader(k) {
+			le.Header[k] = redacted
+		} else {
+			le.Header[k] = strings.Join(e.Header[k], ",")
+		}
+	}
+	if l.opt.MaxBodySize > 0 && e.Body != nil {
+		le.Body = l.body(e.Header.Get("Content-Type"), e.Body())
+	}
+	return le
+}
+
+func (l *structuredLogger) isSensitiveHeader(name string) bool {
+	if l.headers[syshttp.CanonicalHeaderKey(name)] {
+		return true
+	}
+	for _, re := range l.opt.HeaderPatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *structuredLogger) body(contentType string, data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	if isBinaryBody(contentType, data) {
+		return fmt.Sprintf("<binary %d bytes>", len(data))
+	}
+	text := string(data)
+	if len(l.fields) > 0 {
+		text = l.redactFields(contentType, data)
+	}
+	for _, re := range l.opt.BodyPatterns {
+		text = re.ReplaceAllString(text, redacted)
+	}
+	if len(text) > l.opt.MaxBodySize {
+		/* cut at rune boundary */
+		n := l.opt.MaxBodySize
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = fmt.Sprintf("%s...(%d bytes truncated)", text[:n], len(text)-n)
+	}
+	return text
+}
+
+func (l *structuredLogger) redactFields(contentType string, data []byte) string {
+	if strings.Contains(contentType, "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(data)); err == nil {
+			return l.redactValues(values).Encode()
+		}
+	}
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return string(data)
+	}
+	out, _ := json.Marshal(l.redactJSON(v))
+	return string(out)
+}
+
+func (l *structuredLogger) redactJSON(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if l.fields[k] {
+				val[k] = redacted
+			} else {
+				val[k] = l.redactJSON(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = l.redactJSON(item)
+		}
+	}
+	return v
+}
+
+func (l *structuredLogger) redactValues(values url.Values) url.Values {
+	for k := range values {
+		if l.fields[k] {
+			values[k] = []string{redacted}
+		}
+	}
+	return values
+}
+
+func (l *structuredLogger) redactURL(uri string) string {
+	if len(l.fields) == 0 {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.RawQuery == "" {
+		return uri
+	}
+	u.RawQuery = l.redactValues(u.Query()).Encode()
+	return u.String()
+}
+
+func isBinaryBody(contentType string, data []byte) bool {
+	for _, prefix := range []string{"image/", "audio/", "video/", "application/octet-stream", "application/zip", "application/gzip", "application/pdf"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0
+}
+
+func statusCodeOf(status string) int {
+	var code int
+	fmt.Sscanf(status, "%d", &code)
+	return code
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -30,30 +30,76 @@ func middlewareContext(next Endpoint) Endpoint {
 		if gv == nil {
 			return next(req)
 		}
+		/* build per call, endpoint may be called more than once by hedging or failover */
+		handler := next
 
 		/* mock */
 		if gv.Mock != nil {
-			next = middlewareSetMock(gv.Mock)(next)
+			handler = middlewareSetMock(gv.Mock)(handler)
+		}
+
+		/* cassette replay */
+		if gv.Cassette != nil && !gv.Cassette.isRecording() {
+			handler = middlewareSetMock(gv.Cassette.replay)(handler)
+		}
+
+		/* trace closest to transport, so saving body is measured.
+		parent is resolved once here, hedged attempts clone gv and must share it */
+		if gv.Tracer != nil {
+			if gv.TraceParent == nil {
+				parent := resolveTraceParent(req)
+				gv.TraceParent = &parent
+			}
+			handler = middlewareTrace(gv.Tracer)(handler)
 		}
 
 		/* download body */
-		next = middlewareSaveResponse(gv.BodySaver)(next)
+		if !gv.Stream || gv.BodySaver != nil {
+			handler = middlewareSaveResponse(gv.BodySaver)(handler)
+		}
+
+		/* cassette record */
+		if gv.Cassette != nil && gv.Cassette.isRecording() {
+			handler = middlewareDebug(gv.Cassette.record)(handler)
+		}
 
 		/* log */
 		if gv.Debugger != nil {
-			next = middlewareDebug(gv.Debugger)(next)
+			handler = middlewareDebug(gv.Debugger)(handler)
+		}
+
+		/* sign every attempt before log, so log shows signed request */
+		if len(gv.Signers) > 0 {
+			handler = middlewareSign(gv.Signers)(handler)
 		}
 
 		/* timeout */
-		if gv.Timeout > 0 {
-			next = middlewareTimeout(gv.Timeout)(next)
+		if gv.Timeout > 0 && gv.Stream {
+			handler = middlewareHeaderTimeout(gv.Timeout)(handler)
+		} else if gv.Timeout > 0 {
+			handler = middlewareTimeout(gv.Timeout)(handler)
+		}
+
+		/* rate limit every attempt */
+		if len(gv.RateLimiters) > 0 {
+			handler = middlewareRateLimit(gv.RateLimiters)(handler)
 		}
 
 		/* retry */
 		if gv.RetryOption != nil && gv.RetryOption.RetryMax > 0 {
-			next = middlewareRetry(gv.RetryOption)(next)
+			handler = middlewareRetry(gv.RetryOption)(handler)
 		}
-		return next(req)
+
+		/* hedge retries, attempts can not share body saver */
+		if gv.Hedge != nil && gv.BodySaver == nil {
+			handler = middlewareHedge(gv.Hedge)(handler)
+		}
+
+		/* cache hits skip all above */
+		if gv.Cache != nil && !gv.Stream && gv.BodySaver == nil {
+			handler = middlewareCache(gv.Cache, gv.CacheMode)(handler)
+		}
+		return handler(req)
 	}
 }
 
@@ -78,6 +124,27 @@ func middlewareTimeout(tm time.Duration) Middleware {
 	}
 }
 
+// middlewareHeaderTimeout limit waiting for response header, body is readable until closed
+func middlewareHeaderTimeout(tm time.Duration) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			ctx, cancel := context.WithCancel(req.Context())
+			timer := time.AfterFunc(tm, cancel)
+			res, err := next(req.WithContext(ctx))
+			timedOut := !timer.Stop()
+			if err != nil || res == nil || res.Body == nil {
+				cancel()
+				if err != nil && timedOut {
+					err = fmt.Errorf("%v timeout:%v", err, tm)
+				}
+				return res, err
+			}
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+			return res, err
+		}
+	}
+}
+
 func middlewareSaveResponse(w io.Writer) Middleware {
 	return func(next Endpoint) Endpoint {
 		return func(req *syshttp.Request) (*syshttp.Response, error) {
@@ -116,6 +183,7 @@ type TransportInfo struct {
 	Err      error
 	Request  *TransportEntity
 	Response *TransportEntity
+	Timing   *TransportTiming // set by TraceMiddleware
 }
 
 func DefaultLogger(ctx context.Context, info *TransportInfo) {
@@ -169,7 +237,12 @@ func middlewareDebug(loggerFn HTTPLogger) Middleware {
 			info.Request = &TransportEntity{
 				Header: req.Header,
 			}
-			reqBody, _ := RepeatableReadRequest(req)
+			var reqBody []byte
+			if sb, ok := req.Body.(streamBody); ok {
+				reqBody = sb.Summary()
+			} else {
+				reqBody, _ = RepeatableReadRequest(req)
+			}
 			info.Request.Body = func() []byte {
 				return reqBody
 			}
@@ -178,12 +251,20 @@ func middlewareDebug(loggerFn HTTPLogger) Middleware {
 			info.StartAt = now
 			info.Cost = time.Since(now)
 			info.Response = &TransportEntity{}
+			if gv := getValue(req); gv != nil && gv.Tracer != nil && gv.Timing != nil {
+				timing := gv.Timing.snapshot()
+				info.Timing = &timing
+			}
 			if err != nil {
 				info.Err = err
 			} else {
 				info.Status = res.Status
 				info.Response.Header = res.Header
 				info.Response.Body = func() []byte {
+					/* stream body is left to caller */
+					if gv := getValue(req); gv != nil && gv.Stream {
+						return nil
+					}
 					resBody, _ := RepeatableReadResponse(res)
 					return resBody
 				}
@@ -210,21 +291,30 @@ func middlewareRetry(retryOpt *RetryOption) Middleware {
 	if retryOpt.RetryWaitMax <= 0 {
 		retryOpt.RetryWaitMax = 3 * time.Second
 	}
-	shouldRetry := func(res *syshttp.Response, err error) bool {
-		return err != nil
+	if retryOpt.MaxRetryAfter <= 0 {
+		retryOpt.MaxRetryAfter = retryOpt.RetryWaitMax
+	}
+	/* customized check decides on its own, default one only retries idempotent requests */
+	shouldRetry := func(req *syshttp.Request, res *syshttp.Response, err error) bool {
+		return isIdempotent(req) && DefaultCheckResponse(res, err)
 	}
 	if retryOpt.CheckResponse != nil {
-		shouldRetry = retryOpt.CheckResponse
+		shouldRetry = func(_ *syshttp.Request, res *syshttp.Response, err error) bool {
+			return retryOpt.CheckResponse(res, err)
+		}
+	}
+	backoff := retryOpt.Backoff
+	if backoff == nil {
+		backoff = LinearJitterBackoff(retryOpt.RetryWaitMin, retryOpt.RetryWaitMax)
 	}
 	return func(next Endpoint) Endpoint {
 		return func(req *syshttp.Request) (res *syshttp.Response, err error) {
 			retryHookList := getValue(req).RetryHooks
+			start := time.Now()
+			var wait time.Duration
 			for i := 0; i < retryOpt.RetryMax+1; i++ {
-				/* save request body */
-				if req.Body != nil {
-					if _, err := RepeatableReadRequest(req); err != nil {
-						return nil, err
-					}
+				if err := prepareAttemptBody(req, i); err != nil {
+					return nil, err
 				}
 
 				/* do retry hook */
@@ -236,15 +326,27 @@ func middlewareRetry(retryOpt *RetryOption) Middleware {
 
 				/* do request */
 				res, err = next(req)
-				if !shouldRetry(res, err) {
+				if i == retryOpt.RetryMax || !shouldRetry(req, res, err) {
 					break
 				}
 
+				wait = backoff(i, wait)
+				/* server tells when to retry */
+				if after, ok := retryAfter(res); ok {
+					if after > retryOpt.MaxRetryAfter {
+						break
+					}
+					wait = after
+				}
+				/* retry budget exhausted */
+				if retryOpt.MaxElapsed > 0 && time.Since(start)+wait > retryOpt.MaxElapsed {
+					break
+				}
 				if res != nil && res.Body != nil {
 					drainBody(res.Body)
 				}
-				if i < retryOpt.RetryMax {
-					time.Sleep(linearJitterBackoff(retryOpt.RetryWaitMin, retryOpt.RetryWaitMax, i))
+				if err := sleepContext(req.Context(), wait); err != nil {
+					return nil, err
 				}
 			}
 			return
@@ -252,6 +354,47 @@ func middlewareRetry(retryOpt *RetryOption) Middleware {
 	}
 }
 
+// prepareAttemptBody keep request body readable for later attempts, stream body is reopened from the second attempt instead of buffered
+func prepareAttemptBody(req *syshttp.Request, attempt int) error {
+	if sb, ok := req.Body.(streamBody); ok {
+		if attempt > 0 {
+			req.Body = sb.Rewind()
+		}
+		return nil
+	}
+	if req.Body != nil {
+		_, err := RepeatableReadRequest(req)
+		return err
+	}
+	return nil
+}
+
+// DefaultCheckResponse retry on connection errors, 429 and 5xx except 501
+func DefaultCheckResponse(res *syshttp.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if res == nil {
+		return false
+	}
+	return res.StatusCode == syshttp.StatusTooManyRequests ||
+		(res.StatusCode >= 500 && res.StatusCode != syshttp.StatusNotImplemented)
+}
+
+func isIdempotent(req *syshttp.Request) bool {
+	if gv := getValue(req); gv != nil && gv.Idempotent {
+		return true
+	}
+	if req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
 func drainBody(body io.ReadCloser) error {
 	defer body.Close()
 	_, err := io.Copy(ioutil.Discard, io.LimitReader(body, 4096))
@@ -317,7 +460,7 @@ func MiddlewareCheckStatusCode(fn func(int) bool) Middleware {
 			}
 			if !fn(resp.StatusCode) {
 				data, _ := RepeatableReadResponse(resp)
-				return nil, fmt.Errorf("%s %s", resp.Status, data)
+				return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: data}
 			}
 			return resp, err
 		}
@@ -0,0 +1,304 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	syshttp "net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestingT is satisfied by *testing.T
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+type MockFault int
+
+const (
+	FaultNone MockFault = iota
+	// FaultConnectionReset close connection without response
+	FaultConnectionReset
+	// FaultSlowBody write response body byte by byte with delay
+	FaultSlowBody
+)
+
+// MockServer is a stub server for tests
+//
+//	server := NewMockServer()
+//	server.On("GET", "/users/:id").WithHeader("Token", "x").Reply(200, user)
+//	defer server.ServeBackground()()
+type MockServer struct {
+	mux       *syshttp.ServeMux
+	server    *ServerOnAnyPort
+	URLPrefix string
+	mu        sync.Mutex
+	stubs     []*Stub
+	calls     []*MockCall
+}
+
+// MockCall is a request received by mock server
+type MockCall struct {
+	Method string
+	Path   string
+	Query  map[string][]string
+	Header syshttp.Header
+	Body   []byte
+	At     time.Time
+}
+
+func NewMockServer() *MockServer {
+	return &MockServer{mux: syshttp.NewServeMux()}
+}
+
+// Handle register raw handler, stubs take precedence
+func (ms *MockServer) Handle(path string, fn func(w syshttp.ResponseWriter, req *syshttp.Request)) *MockServer {
+	ms.mux.HandleFunc(path, fn)
+	return ms
+}
+
+// On stub requests of method and path pattern, segments like :id match anything, later stubs take precedence
+func (ms *MockServer) On(method, pattern string) *Stub {
+	stub := &Stub{method: method, pattern: pattern, status: syshttp.StatusOK, header: make(syshttp.Header)}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.stubs = append(ms.stubs, stub)
+	return stub
+}
+
+func (ms *MockServer) ServeBackground() func() {
+	ms.server = ListenOnAnyPort(ms)
+	go ms.server.Serve()
+	ms.URLPrefix = "http://127.0.0.1" + ms.server.Addr()
+	return func() {
+		ms.server.Close()
+	}
+}
+
+func (ms *MockServer) ServeHTTP(w syshttp.ResponseWriter, req *syshttp.Request) {
+	call := &MockCall{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Header: req.Header.Clone(),
+		At:     time.Now(),
+	}
+	call.Body, _ = ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(strings.NewReader(string(call.Body)))
+	ms.mu.Lock()
+	ms.calls = append(ms.calls, call)
+	var stub *Stub
+	var params map[string]string
+	for i := len(ms.stubs) - 1; i >= 0; i-- {
+		if p, ok := ms.stubs[i].match(req); ok {
+			stub, params = ms.stubs[i], p
+			break
+		}
+	}
+	ms.mu.Unlock()
+
+	if stub != nil {
+		stub.serve(w, req, params)
+	} else if _, pattern := ms.mux.Handler(req); pattern != "" {
+		ms.mux.ServeHTTP(w, req)
+	} else {
+		syshttp.Error(w, fmt.Sprintf("mock server: no stub for %s %s", req.Method, req.URL.Path), syshttp.StatusNotFound)
+	}
+}
+
+// Calls return requests matched method and path pattern, empty method or pattern matches all
+func (ms *MockServer) Calls(method, pattern string) []*MockCall {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var list []*MockCall
+	for _, call := range ms.calls {
+		if method != "" && !strings.EqualFold(method, call.Method) {
+			continue
+		}
+		if _, ok := matchPathPattern(pattern, call.Path); pattern != "" && !ok {
+			continue
+		}
+		list = append(list, call)
+	}
+	return list
+}
+
+// AssertCalled check the route is called, or exactly called times[0] times
+func (ms *MockServer) AssertCalled(t TestingT, method, pattern string, times ...int) bool {
+	count := len(ms.Calls(method, pattern))
+	if len(times) > 0 && count != times[0] {
+		t.Errorf("expect %s %s called %d times, actual %d", method, pattern, times[0], count)
+		return false
+	} else if count == 0 {
+		t.Errorf("expect %s %s called, but not", method, pattern)
+		return false
+	}
+	return true
+}
+
+func (ms *MockServer) AssertNotCalled(t TestingT, method, pattern string) bool {
+	if count := len(ms.Calls(method, pattern)); count > 0 {
+		t.Errorf("expect %s %s not called, but called %d times", method, pattern, count)
+		return false
+	}
+	return true
+}
+
+type Stub struct {
+	method    string
+	pattern   string
+	reqHeader map[string]string
+	status    int
+	header    syshttp.Header
+	body      []byte
+	replyFn   func(*syshttp.Request, map[string]string) (int, interface{})
+	delay     time.Duration
+	fault     MockFault
+	faultWait time.Duration
+}
+
+// WithHeader only match requests with the header
+func (s *Stub) WithHeader(k, v string) *Stub {
+	if s.reqHeader == nil {
+		s.reqHeader = make(map[string]string)
+	}
+	s.reqHeader[k] = v
+	return s
+}
+
+// Reply with status and body, body other than string or []byte is encoded to json
+func (s *Stub) Reply(status int, body interface{}) *Stub {
+	s.status = status
+	s.body = encodeMockBody(s.header, body)
+	return s
+}
+
+// ReplyFunc build reply by request and path params
+func (s *Stub) ReplyFunc(fn func(req *syshttp.Request, params map[string]string) (status int, body interface{})) *Stub {
+	s.replyFn = fn
+	return s
+}
+
+func (s *Stub) ReplyHeader(k, v string) *Stub {
+	s.header.Set(k, v)
+	return s
+}
+
+// Delay reply after d
+func (s *Stub) Delay(d time.Duration) *Stub {
+	s.delay = d
+	return s
+}
+
+// Fault inject failure, wait is the delay between bytes of FaultSlowBody
+func (s *Stub) Fault(fault MockFault, wait ...time.Duration) *Stub {
+	s.fault = fault
+	if len(wait) > 0 {
+		s.faultWait = wait[0]
+	}
+	return s
+}
+
+func (s *Stub) match(req *syshttp.Request) (map[string]string, bool) {
+	if s.method != "" && !strings.EqualFold(s.method, req.Method) {
+		return nil, false
+	}
+	for k, v := range s.reqHeader {
+		if req.Header.Get(k) != v {
+			return nil, false
+		}
+	}
+	return matchPathPattern(s.pattern, req.URL.Path)
+}
+
+func (s *Stub) serve(w syshttp.ResponseWriter, req *syshttp.Request, params map[string]string) {
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if s.fault == FaultConnectionReset {
+		resetConnection(w)
+		return
+	}
+	status, body := s.status, s.body
+	for k := range s.header {
+		w.Header().Set(k, s.header.Get(k))
+	}
+	if s.replyFn != nil {
+		var v interface{}
+		status, v = s.replyFn(req, params)
+		body = encodeMockBody(w.Header(), v)
+	}
+	w.WriteHeader(status)
+	if s.fault != FaultSlowBody {
+		w.Write(body)
+		return
+	}
+	flusher, _ := w.(syshttp.Flusher)
+	for i := range body {
+		if _, err := w.Write(body[i : i+1]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		time.Sleep(s.faultWait)
+	}
+}
+
+func encodeMockBody(header syshttp.Header, body interface{}) []byte {
+	switch v := body.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	default:
+		data, _ := json.Marshal(v)
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "application/json")
+		}
+		return data
+	}
+}
+
+func resetConnection(w syshttp.ResponseWriter) {
+	hj, ok := w.(syshttp.Hijacker)
+	if !ok {
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		/* send RST instead of FIN */
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// matchPathPattern match path like /users/42 with pattern /users/:id
+func matchPathPattern(pattern, path string) (map[string]string, bool) {
+	ps := strings.Split(strings.Trim(pattern, "/"), "/")
+	ss := strings.Split(strings.Trim(path, "/"), "/")
+	if len(ps) != len(ss) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i := range ps {
+		if strings.HasPrefix(ps[i], ":") {
+			params[ps[i][1:]] = ss[i]
+		} else if ps[i] != ss[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
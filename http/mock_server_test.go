@@ -6,32 +6,6 @@ import (
 	"net/http"
 )
 
-type MockServer struct {
-	mux       *http.ServeMux
-	server    *ServerOnAnyPort
-	URLPrefix string
-}
-
-func NewMockServer() *MockServer {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/echo", Echo)
-	return &MockServer{mux: mux}
-}
-
-func (ms *MockServer) Handle(path string, fn func(w http.ResponseWriter, req *http.Request)) *MockServer {
-	ms.mux.HandleFunc(path, fn)
-	return ms
-}
-
-func (ms *MockServer) ServeBackground() func() {
-	ms.server = ListenOnAnyPort(ms.mux)
-	go ms.server.Serve()
-	ms.URLPrefix = "http://127.0.0.1" + ms.server.Addr()
-	return func() {
-		ms.server.Close()
-	}
-}
-
 func Echo(w http.ResponseWriter, req *http.Request) {
 	args := make(map[string]string)
 	qs := req.URL.Query()
@@ -0,0 +1,278 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	syshttp "net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Part is a part of multipart/form-data body, content is opened on every attempt and streamed
+type Part struct {
+	Name        string
+	FileName    string                        // optional, makes it a file part
+	ContentType string                        // optional, default application/octet-stream for file part
+	Header      map[string]string             // optional, extra part headers
+	Size        int64                         // optional, -1 means unknown, request is chunked if any part size unknown
+	Open        func() (io.ReadCloser, error) // content source
+}
+
+// FieldPart is a plain form field
+func FieldPart(name, value string) Part {
+	return Part{
+		Name: name,
+		Size: int64(len(value)),
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(value)), nil
+		},
+	}
+}
+
+// FilePart stream file of path, content type is guessed by extension
+func FilePart(name, path string) Part {
+	part := Part{
+		Name:        name,
+		FileName:    filepath.Base(path),
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		Size:        -1,
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}
+	if fi, err := os.Stat(path); err == nil {
+		part.Size = fi.Size()
+	}
+	return part
+}
+
+// ReaderPart stream r as a file part, r can be reopened for retry only if it is an io.Seeker
+func ReaderPart(name, fileName string, r io.Reader) Part {
+	var opened bool
+	return Part{
+		Name:     name,
+		FileName: fileName,
+		Size:     -1,
+		Open: func() (io.ReadCloser, error) {
+			if opened {
+				seeker, ok := r.(io.Seeker)
+				if !ok {
+					return nil, fmt.Errorf("multipart: part %s can not be reopened", name)
+				}
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+			opened = true
+			return ioutil.NopCloser(r), nil
+		},
+	}
+}
+
+// WithPartHeader set extra header of part
+func (p Part) WithPartHeader(k, v string) Part {
+	header := make(map[string]string)
+	for key, val := range p.Header {
+		header[key] = val
+	}
+	header[k] = v
+	p.Header = header
+	return p
+}
+
+func (p Part) WithContentType(ct string) Part {
+	p.ContentType = ct
+	return p
+}
+
+func (p Part) mimeHeader() textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+	disposition := fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(p.Name))
+	if p.FileName != "" {
+		disposition += fmt.Sprintf(`; filename="%s"`, escapeQuotes(p.FileName))
+	}
+	header.Set("Content-Disposition", disposition)
+	if ct := p.ContentType; ct != "" {
+		header.Set("Content-Type", ct)
+	} else if p.FileName != "" {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	for k, v := range p.Header {
+		header.Set(k, v)
+	}
+	return header
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// PostMultipart post multipart/form-data, parts are streamed without buffering in memory
+func (client *clientImpl) PostMultipart(ctx context.Context, urlstr string, parts []Part, opts ...Option) *Response {
+	body := newMultipartBody(parts, randomBoundary())
+	req, err := syshttp.NewRequest("POST", urlstr, body)
+	if err != nil {
+		return buildResponse(nil, err)
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	req.ContentLength = body.Size()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return body.Rewind(), nil
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+body.boundary)
+	res, err := client.makeFinalHandler(client.getOptionMiddlewares(opts...)...)(req)
+	return buildResponse(res, err)
+}
+
+func randomBoundary() string {
+	var buf [24]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf[:])
+}
+
+// streamBody is a request body can not be buffered, retry rewinds it and logger prints its summary
+type streamBody interface {
+	io.ReadCloser
+	Rewind() io.ReadCloser
+	Summary() []byte
+}
+
+type multipartBody struct {
+	parts    []Part
+	boundary string
+	once     sync.Once
+	pr       *io.PipeReader
+	mu       sync.Mutex
+	closed   bool
+}
+
+func newMultipartBody(parts []Part, boundary string) *multipartBody {
+	return &multipartBody{parts: parts, boundary: boundary}
+}
+
+// Read start writing parts lazily, so an unsent body holds no goroutine
+func (mb *multipartBody) Read(p []byte) (int, error) {
+	mb.once.Do(func() {
+		pr, pw := io.Pipe()
+		mb.mu.Lock()
+		mb.pr = pr
+		if mb.closed {
+			pr.Close()
+		}
+		mb.mu.Unlock()
+		go func() {
+			pw.CloseWithError(mb.write(pw, false))
+		}()
+	})
+	return mb.pr.Read(p)
+}
+
+func (mb *multipartBody) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.closed = true
+	if mb.pr != nil {
+		return mb.pr.Close()
+	}
+	return nil
+}
+
+func (mb *multipartBody) Rewind() io.ReadCloser {
+	return newMultipartBody(mb.parts, mb.boundary)
+}
+
+// Size return content length, -1 if any part size unknown
+func (mb *multipartBody) Size() int64 {
+	counter := &countWriter{}
+	if err := mb.write(counter, true); err != nil {
+		return -1
+	}
+	return counter.n
+}
+
+// Summary print fields and elide file contents
+func (mb *multipartBody) Summary() []byte {
+	buf := new(bytes.Buffer)
+	for _, part := range mb.parts {
+		if part.FileName != "" {
+			fmt.Fprintf(buf, "%s: <file %s, %d bytes elided>\n", part.Name, part.FileName, part.Size)
+			continue
+		}
+		if part.Size < 0 || part.Size > 1024 {
+			fmt.Fprintf(buf, "%s: <%d bytes elided>\n", part.Name, part.Size)
+			continue
+		}
+		data, err := readPart(part)
+		if err != nil || !utf8.Valid(data) {
+			fmt.Fprintf(buf, "%s: <binary %d bytes elided>\n", part.Name, len(data))
+			continue
+		}
+		fmt.Fprintf(buf, "%s: %s\n", part.Name, data)
+	}
+	return buf.Bytes()
+}
+
+func readPart(part Part) ([]byte, error) {
+	rc, err := part.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// write parts into w, dry run only counts bytes by part size
+func (mb *multipartBody) write(w io.Writer, dryRun bool) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(mb.boundary); err != nil {
+		return err
+	}
+	for _, part := range mb.parts {
+		pw, err := mw.CreatePart(part.mimeHeader())
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			if part.Size < 0 {
+				return fmt.Errorf("multipart: size of part %s unknown", part.Name)
+			}
+			w.(*countWriter).n += part.Size
+			continue
+		}
+		rc, err := part.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(pw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
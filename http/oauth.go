@@ -0,0 +1,215 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	syshttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresIn    int64     `json:"expires_in,omitempty"`
+	Expiry       time.Time `json:"-"` // zero means never expires
+}
+
+func (t *Token) expiresWithin(d time.Duration) bool {
+	return !t.Expiry.IsZero() && time.Until(t.Expiry) <= d
+}
+
+// Authorization return value of Authorization header
+func (t *Token) Authorization() string {
+	typ := t.TokenType
+	if typ == "" || strings.EqualFold(typ, "bearer") {
+		typ = "Bearer"
+	}
+	return typ + " " + t.AccessToken
+}
+
+// TokenSource fetch a new token on every call, wrap it by ReuseTokenSource to cache
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+type TokenSourceFunc func(ctx context.Context) (*Token, error)
+
+func (fn TokenSourceFunc) Token(ctx context.Context) (*Token, error) {
+	return fn(ctx)
+}
+
+func StaticTokenSource(accessToken string) TokenSource {
+	return TokenSourceFunc(func(context.Context) (*Token, error) {
+		return &Token{AccessToken: accessToken}, nil
+	})
+}
+
+// ReusableTokenSource cache token and refresh it before expiry, concurrent refreshes are serialized
+type ReusableTokenSource struct {
+	mu        sync.Mutex
+	src       TokenSource
+	leeway    time.Duration
+	token     *Token
+	fetchedAt time.Time
+}
+
+// ReuseTokenSource refresh token when it expires within leeway, leeway is at most half of token lifetime
+// so short lived tokens are still reused
+func ReuseTokenSource(src TokenSource, leeway time.Duration) *ReusableTokenSource {
+	if rts, ok := src.(*ReusableTokenSource); ok {
+		return rts
+	}
+	return &ReusableTokenSource{src: src, leeway: leeway}
+}
+
+func (s *ReusableTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && !s.token.expiresWithin(s.leewayOf(s.token)) {
+		return s.token, nil
+	}
+	tok, err := s.src.Token(ctx)
+	if err != nil {
+		/* refresh ahead failed, old one is still usable */
+		if s.token != nil && !s.token.expiresWithin(0) {
+			return s.token, nil
+		}
+		return nil, err
+	}
+	s.token = tok
+	s.fetchedAt = time.Now()
+	return tok, nil
+}
+
+func (s *ReusableTokenSource) leewayOf(tok *Token) time.Duration {
+	if half := tok.Expiry.Sub(s.fetchedAt) / 2; !tok.Expiry.IsZero() && half < s.leeway {
+		return half
+	}
+	return s.leeway
+}
+
+// Invalidate drop cached token if it is still tok, so concurrent 401s refresh only once
+func (s *ReusableTokenSource) Invalidate(tok *Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == tok {
+		s.token = nil
+	}
+}
+
+type OAuth2Option struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string          // optional
+	RefreshToken string            // optional, use refresh token flow, otherwise client credentials flow
+	Params       map[string]string // optional, extra form params like audience
+	AuthInHeader bool              // optional, send client credentials by basic auth instead of form
+}
+
+// OAuth2Error is the error envelope of token endpoint, found in HTTPError.Decoded
+type OAuth2Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+type oauth2TokenSource struct {
+	mu      sync.Mutex
+	client  Client
+	opt     OAuth2Option
+	refresh string
+}
+
+// NewOAuth2TokenSource fetch token from token url by client credentials or refresh token flow.
+// Refresh token returned by server is used for next fetch. client must not use this source itself
+func NewOAuth2TokenSource(client Client, opt OAuth2Option) TokenSource {
+	if client == nil {
+		client = NewClient()
+	}
+	return &oauth2TokenSource{client: client, opt: opt, refresh: opt.RefreshToken}
+}
+
+func (s *oauth2TokenSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	form := url.Values{}
+	if s.refresh != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.refresh)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(s.opt.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.opt.Scopes, " "))
+	}
+	for k, v := range s.opt.Params {
+		form.Set(k, v)
+	}
+	var opts []Option
+	if s.opt.AuthInHeader {
+		opts = append(opts, WithBeforeHook(func(req *syshttp.Request) {
+			req.SetBasicAuth(url.QueryEscape(s.opt.ClientID), url.QueryEscape(s.opt.ClientSecret))
+		}))
+	} else {
+		form.Set("client_id", s.opt.ClientID)
+		form.Set("client_secret", s.opt.ClientSecret)
+	}
+	opts = append(opts, WithHeaders(map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Accept":       "application/json",
+	}))
+	tok := new(Token)
+	if err := s.client.Post(ctx, s.opt.TokenURL, []byte(form.Encode()), opts...).Decode(tok, new(OAuth2Error)); err != nil {
+		return nil, err
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("oauth2: no access token from %s", s.opt.TokenURL)
+	}
+	if tok.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	if tok.RefreshToken != "" {
+		s.refresh = tok.RefreshToken
+	}
+	return tok, nil
+}
+
+// BearerTokenMiddleware set Authorization header by token source, refreshing token a minute before expiry,
+// pass a ReusableTokenSource to use another leeway. On 401 the token is refreshed and the request is retried once
+func BearerTokenMiddleware(src TokenSource) Middleware {
+	rts := ReuseTokenSource(src, time.Minute)
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			tok, err := rts.Token(req.Context())
+			if err != nil {
+				return nil, err
+			}
+			/* keep body for the retry */
+			if err := prepareAttemptBody(req, 0); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", tok.Authorization())
+			res, err := next(req)
+			if err != nil || res.StatusCode != syshttp.StatusUnauthorized {
+				return res, err
+			}
+			rts.Invalidate(tok)
+			tok, err = rts.Token(req.Context())
+			if err != nil {
+				return res, nil
+			}
+			if res.Body != nil {
+				drainBody(res.Body)
+			}
+			if err := prepareAttemptBody(req, 1); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", tok.Authorization())
+			return next(req)
+		}
+	}
+}
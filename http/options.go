@@ -61,6 +61,16 @@ func WithBody(w io.Writer) Option {
 	})
 }
 
+// WithStream keep response body unread for Lines, DecodeStream and Events, timeout only limits waiting for response header
+func WithStream() Option {
+	return WithMiddleware(func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).Stream = true
+			return next(req)
+		}
+	})
+}
+
 func WithAfterHook(hook func(*syshttp.Response)) Option {
 	return WithMiddleware(func(next Endpoint) Endpoint {
 		return func(req *syshttp.Request) (*syshttp.Response, error) {
@@ -73,6 +83,16 @@ func WithAfterHook(hook func(*syshttp.Response)) Option {
 	})
 }
 
+// WithIdempotent mark request safe to retry by default policy, like a POST with idempotency key
+func WithIdempotent() Option {
+	return WithMiddleware(func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).Idempotent = true
+			return next(req)
+		}
+	})
+}
+
 func WithHeaders(hdr map[string]string) Option {
 	return WithMiddleware(func(next Endpoint) Endpoint {
 		return func(req *syshttp.Request) (*syshttp.Response, error) {
@@ -92,7 +112,10 @@ type RetryOption struct {
 	RetryMax      int
 	RetryWaitMin  time.Duration                                     // optional
 	RetryWaitMax  time.Duration                                     // optional
-	CheckResponse func(*syshttp.Response, error) (shouldRetry bool) // optional
+	CheckResponse func(*syshttp.Response, error) (shouldRetry bool) // optional, default DefaultCheckResponse for idempotent requests
+	Backoff       Backoff                                           // optional, default linear jitter between RetryWaitMin and RetryWaitMax
+	MaxElapsed    time.Duration                                     // optional, stop retrying when total time would exceed it
+	MaxRetryAfter time.Duration                                     // optional, stop retrying when Retry-After of server is longer, default RetryWaitMax
 }
 
 func setRequestHeader(req *syshttp.Request, header map[string]string) {
@@ -0,0 +1,203 @@
+package http
+
+import (
+	"context"
+	syshttp "net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimitOption struct {
+	Rate        float64 // optional, requests per second, 0 means unlimited
+	Burst       int     // optional, max tokens of bucket, default 1
+	MaxInFlight int     // optional, max concurrent requests, 0 means unlimited
+	PerHost     bool    // optional, limit every host separately
+}
+
+// RateLimitMiddleware limit every attempt of requests, waiting respects request context.
+// A 429 response with Retry-After pauses the limiter until then
+func RateLimitMiddleware(opt RateLimitOption) Middleware {
+	rl := newRateLimiter(opt)
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).AddRateLimiter(rl)
+			return next(req)
+		}
+	}
+}
+
+func middlewareRateLimit(limiters []*rateLimiter) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			var acquired []*hostLimiter
+			defer func() {
+				for _, hl := range acquired {
+					hl.Release()
+				}
+			}()
+			for _, rl := range limiters {
+				hl := rl.Get(req.URL.Host)
+				if err := hl.Acquire(req.Context()); err != nil {
+					return nil, err
+				}
+				acquired = append(acquired, hl)
+			}
+			res, err := next(req)
+			if wait, ok := retryAfter(res); ok && res.StatusCode == syshttp.StatusTooManyRequests {
+				for _, hl := range acquired {
+					hl.Pause(wait)
+				}
+			}
+			return res, err
+		}
+	}
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	opt    RateLimitOption
+	global *hostLimiter
+	hosts  map[string]*hostLimiter
+}
+
+func newRateLimiter(opt RateLimitOption) *rateLimiter {
+	if opt.Burst <= 0 {
+		opt.Burst = 1
+	}
+	rl := &rateLimiter{opt: opt, hosts: make(map[string]*hostLimiter)}
+	if !opt.PerHost {
+		rl.global = newHostLimiter(opt)
+	}
+	return rl
+}
+
+func (rl *rateLimiter) Get(host string) *hostLimiter {
+	if !rl.opt.PerHost {
+		return rl.global
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	hl, ok := rl.hosts[host]
+	if !ok {
+		hl = newHostLimiter(rl.opt)
+		rl.hosts[host] = hl
+	}
+	return hl
+}
+
+type hostLimiter struct {
+	sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	last       time.Time
+	pauseUntil time.Time
+	inflight   chan struct{}
+}
+
+func newHostLimiter(opt RateLimitOption) *hostLimiter {
+	hl := &hostLimiter{
+		rate:   opt.Rate,
+		burst:  float64(opt.Burst),
+		tokens: float64(opt.Burst),
+		last:   time.Now(),
+	}
+	if opt.MaxInFlight > 0 {
+		hl.inflight = make(chan struct{}, opt.MaxInFlight)
+	}
+	return hl
+}
+
+func (hl *hostLimiter) Acquire(ctx context.Context) error {
+	for {
+		wait := hl.reserve()
+		if wait <= 0 {
+			break
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+	if hl.inflight != nil {
+		select {
+		case hl.inflight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (hl *hostLimiter) Release() {
+	if hl.inflight != nil {
+		<-hl.inflight
+	}
+}
+
+func (hl *hostLimiter) Pause(d time.Duration) {
+	hl.Lock()
+	defer hl.Unlock()
+	if until := time.Now().Add(d); until.After(hl.pauseUntil) {
+		hl.pauseUntil = until
+	}
+}
+
+// reserve take a token, or return duration to wait for one
+func (hl *hostLimiter) reserve() time.Duration {
+	hl.Lock()
+	defer hl.Unlock()
+	now := time.Now()
+	if now.Before(hl.pauseUntil) {
+		return hl.pauseUntil.Sub(now)
+	}
+	if hl.rate <= 0 {
+		return 0
+	}
+	hl.tokens += now.Sub(hl.last).Seconds() * hl.rate
+	if hl.tokens > hl.burst {
+		hl.tokens = hl.burst
+	}
+	hl.last = now
+	if hl.tokens >= 1 {
+		hl.tokens--
+		return 0
+	}
+	return time.Duration((1 - hl.tokens) / hl.rate * float64(time.Second))
+}
+
+// retryAfter parse Retry-After header in seconds or http date
+func retryAfter(res *syshttp.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+	val := res.Header.Get("Retry-After")
+	if val == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(val); err == nil {
+		if sec < 0 {
+			sec = 0
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	if at, err := syshttp.ParseTime(val); err == nil {
+		wait := time.Until(at)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
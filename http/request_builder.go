@@ -0,0 +1,216 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	syshttp "net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// HTTPError is returned for non 2xx response, Decoded is the error envelope if body decoded
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+	Decoded    interface{}
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s", e.Status, e.Body)
+}
+
+// Decode unmarshal 2xx json body into success, or return *HTTPError with body unmarshaled into errorEnvelope.
+// Both pointers are optional
+func (r *Response) Decode(success interface{}, errorEnvelope interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	data, err := r.GetBody()
+	if err != nil {
+		return err
+	}
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		herr := &HTTPError{StatusCode: r.StatusCode, Status: r.Status, Body: data}
+		if errorEnvelope != nil && len(data) > 0 && json.Unmarshal(data, errorEnvelope) == nil {
+			herr.Decoded = errorEnvelope
+		}
+		return herr
+	}
+	if success == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, success)
+}
+
+// RequestBuilder build request fluently, uri must be absolute unless base urls are set by SetFailover
+//
+//	var user User
+//	err := client.NewRequest("GET", "https://api.example.com/users/{id}").PathParam("id", 1).QueryStruct(filter).Do(ctx).Decode(&user, &apiErr)
+type RequestBuilder struct {
+	client  *clientImpl
+	method  string
+	uri     string
+	params  map[string]string
+	query   url.Values
+	header  map[string]string
+	body    func() (io.Reader, error)
+	options []Option
+	err     error
+}
+
+func (client *clientImpl) NewRequest(method, uri string) *RequestBuilder {
+	return &RequestBuilder{
+		client: client,
+		method: method,
+		uri:    uri,
+		params: make(map[string]string),
+		query:  make(url.Values),
+		header: make(map[string]string),
+	}
+}
+
+// PathParam replace {name} in uri with escaped value
+func (b *RequestBuilder) PathParam(name string, value interface{}) *RequestBuilder {
+	b.params[name] = fmt.Sprint(value)
+	return b
+}
+
+func (b *RequestBuilder) Query(name string, value interface{}) *RequestBuilder {
+	b.query.Add(name, fmt.Sprint(value))
+	return b
+}
+
+// QueryStruct add exported fields of struct as query, tag like `query:"name,omitempty"` renames field, `query:"-"` skips it.
+// Slice fields are added repeatedly
+func (b *RequestBuilder) QueryStruct(v interface{}) *RequestBuilder {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		b.err = fmt.Errorf("query struct must be struct, got %T", v)
+		return b
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, omitempty := field.Name, false
+		if tag := field.Tag.Get("query"); tag == "-" {
+			continue
+		} else if tag != "" {
+			list := strings.Split(tag, ",")
+			if list[0] != "" {
+				name = list[0]
+			}
+			for _, opt := range list[1:] {
+				omitempty = omitempty || opt == "omitempty"
+			}
+		}
+		fv := rv.Field(i)
+		if omitempty && fv.IsZero() {
+			continue
+		}
+		for fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				break
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Ptr {
+			continue
+		}
+		if fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array {
+			for j := 0; j < fv.Len(); j++ {
+				b.query.Add(name, fmt.Sprint(fv.Index(j).Interface()))
+			}
+		} else {
+			b.query.Add(name, fmt.Sprint(fv.Interface()))
+		}
+	}
+	return b
+}
+
+func (b *RequestBuilder) Header(k, v string) *RequestBuilder {
+	b.header[k] = v
+	return b
+}
+
+// JSON set json body, string and []byte are sent as is
+func (b *RequestBuilder) JSON(v interface{}) *RequestBuilder {
+	b.header["Content-Type"] = "application/json; charset=utf-8"
+	b.body = func() (io.Reader, error) {
+		switch d := v.(type) {
+		case string:
+			return strings.NewReader(d), nil
+		case []byte:
+			return bytes.NewReader(d), nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	return b
+}
+
+func (b *RequestBuilder) Body(r io.Reader) *RequestBuilder {
+	b.body = func() (io.Reader, error) {
+		return r, nil
+	}
+	return b
+}
+
+func (b *RequestBuilder) Options(opts ...Option) *RequestBuilder {
+	b.options = append(b.options, opts...)
+	return b
+}
+
+// Build make http request without sending it
+func (b *RequestBuilder) Build(ctx context.Context) (*syshttp.Request, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	var body io.Reader
+	if b.body != nil {
+		var err error
+		if body, err = b.body(); err != nil {
+			return nil, err
+		}
+	}
+	uri := b.uri
+	for k, v := range b.params {
+		uri = strings.Replace(uri, "{"+k+"}", url.PathEscape(v), -1)
+	}
+	req, err := syshttp.NewRequest(b.method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	if len(b.query) > 0 {
+		query := req.URL.Query()
+		for k, list := range b.query {
+			for _, v := range list {
+				query.Add(k, v)
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	setRequestHeader(req, b.header)
+	return req, nil
+}
+
+func (b *RequestBuilder) Do(ctx context.Context) *Response {
+	req, err := b.Build(ctx)
+	if err != nil {
+		return buildResponse(nil, err)
+	}
+	return b.client.DoRequest(req, b.options...)
+}
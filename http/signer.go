@@ -0,0 +1,247 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	syshttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Signer sign request in place before every attempt, body is nil for stream body
+type Signer interface {
+	Sign(req *syshttp.Request, body []byte) error
+}
+
+type SignerFunc func(req *syshttp.Request, body []byte) error
+
+func (fn SignerFunc) Sign(req *syshttp.Request, body []byte) error {
+	return fn(req, body)
+}
+
+// SigningMiddleware sign every attempt after all middlewares applied, so retries are signed again
+func SigningMiddleware(s Signer) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).AddSigner(s)
+			return next(req)
+		}
+	}
+}
+
+func middlewareSign(signers []Signer) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			var body []byte
+			if _, ok := req.Body.(streamBody); !ok && req.Body != nil {
+				var err error
+				if body, err = RepeatableReadRequest(req); err != nil {
+					return nil, err
+				}
+			}
+			for _, s := range signers {
+				if err := s.Sign(req, body); err != nil {
+					return nil, err
+				}
+			}
+			return next(req)
+		}
+	}
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+type HMACSignerOption struct {
+	KeyID         string
+	Secret        []byte
+	SignedHeaders []string         // optional, headers signed besides host, content-type, x-date and x-content-sha256
+	Now           func() time.Time // optional
+}
+
+// NewHMACSigner sign canonical request by HMAC-SHA256, canonical request is
+//
+//	METHOD\nPATH\nSORTED_QUERY\nlowercase-header:value\n...\n\nSIGNED_HEADERS\nHEX(SHA256(BODY))
+//
+// and Authorization is like HMAC-SHA256 Credential=KeyID, SignedHeaders=host;x-date, Signature=HEX.
+// Stream body is signed as UNSIGNED-PAYLOAD instead of its hash
+func NewHMACSigner(opt HMACSignerOption) Signer {
+	if opt.Now == nil {
+		opt.Now = time.Now
+	}
+	return SignerFunc(func(req *syshttp.Request, body []byte) error {
+		req.Header.Set("X-Date", opt.Now().UTC().Format("20060102T150405Z"))
+		payloadHash := hashHex(body)
+		if _, ok := req.Body.(streamBody); ok {
+			payloadHash = unsignedPayload
+		}
+		req.Header.Set("X-Content-Sha256", payloadHash)
+		headers := append([]string{"host", "content-type", "x-date", "x-content-sha256"}, opt.SignedHeaders...)
+		canonicalHeaders, signedHeaders := canonicalHeaders(req, headers)
+		canonical := strings.Join([]string{
+			req.Method,
+			canonicalPath(req.URL, false),
+			canonicalQuery(req.URL),
+			canonicalHeaders,
+			signedHeaders,
+			payloadHash,
+		}, "\n")
+		signature := hex.EncodeToString(hmacSHA256(opt.Secret, canonical))
+		req.Header.Set("Authorization", fmt.Sprintf("HMAC-SHA256 Credential=%s, SignedHeaders=%s, Signature=%s", opt.KeyID, signedHeaders, signature))
+		return nil
+	})
+}
+
+type SigV4Option struct {
+	AccessKey     string
+	SecretKey     string
+	SessionToken  string // optional
+	Region        string
+	Service       string
+	SignPayload   bool             // optional, set X-Amz-Content-Sha256 header like S3 requires
+	SignedHeaders []string         // optional, headers signed besides host, content-type and x-amz-*
+	Now           func() time.Time // optional
+}
+
+// NewSigV4Signer sign request by AWS signature version 4, stream body is signed as UNSIGNED-PAYLOAD
+func NewSigV4Signer(opt SigV4Option) Signer {
+	if opt.Now == nil {
+		opt.Now = time.Now
+	}
+	return SignerFunc(func(req *syshttp.Request, body []byte) error {
+		now := opt.Now().UTC()
+		amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+		req.Header.Set("X-Amz-Date", amzDate)
+		if opt.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", opt.SessionToken)
+		}
+		payloadHash := hashHex(body)
+		if _, ok := req.Body.(streamBody); ok {
+			payloadHash = unsignedPayload
+		}
+		if opt.SignPayload {
+			req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		}
+		headers := append([]string{"host", "content-type"}, opt.SignedHeaders...)
+		for k := range req.Header {
+			if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+				headers = append(headers, k)
+			}
+		}
+		canonicalHeaders, signedHeaders := canonicalHeaders(req, headers)
+		canonical := strings.Join([]string{
+			req.Method,
+			canonicalPath(req.URL, opt.Service != "s3"),
+			canonicalQuery(req.URL),
+			canonicalHeaders,
+			signedHeaders,
+			payloadHash,
+		}, "\n")
+		scope := strings.Join([]string{date, opt.Region, opt.Service, "aws4_request"}, "/")
+		stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex([]byte(canonical))}, "\n")
+		key := hmacSHA256([]byte("AWS4"+opt.SecretKey), date)
+		for _, s := range []string{opt.Region, opt.Service, "aws4_request"} {
+			key = hmacSHA256(key, s)
+		}
+		signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+		req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", opt.AccessKey, scope, signedHeaders, signature))
+		return nil
+	})
+}
+
+// canonicalHeaders return lines of present headers sorted by lowercase name with a trailing new line, and names joined by ;
+func canonicalHeaders(req *syshttp.Request, names []string) (string, string) {
+	values := make(map[string]string)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == "host" {
+			if values[name] = req.Host; req.Host == "" {
+				values[name] = req.URL.Host
+			}
+			continue
+		}
+		if list := req.Header[syshttp.CanonicalHeaderKey(name)]; len(list) > 0 {
+			trimmed := make([]string, len(list))
+			for i := range list {
+				trimmed[i] = strings.Join(strings.Fields(list[i]), " ")
+			}
+			values[name] = strings.Join(trimmed, ",")
+		}
+	}
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := new(strings.Builder)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s:%s\n", k, values[k])
+	}
+	return buf.String(), strings.Join(keys, ";")
+}
+
+// canonicalPath uri encode every segment, twice if doubleEncode
+func canonicalPath(u *url.URL, doubleEncode bool) string {
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		seg = uriEncode(seg)
+		if doubleEncode {
+			seg = uriEncode(seg)
+		}
+		segments[i] = seg
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sort encoded params by name then value
+func canonicalQuery(u *url.URL) string {
+	var pairs [][2]string
+	for k, list := range u.Query() {
+		for _, v := range list {
+			pairs = append(pairs, [2]string{uriEncode(k), uriEncode(v)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	list := make([]string, len(pairs))
+	for i, p := range pairs {
+		list[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(list, "&")
+}
+
+// uriEncode escape all but unreserved characters of RFC 3986
+func uriEncode(s string) string {
+	buf := new(strings.Builder)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,287 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Lines call fn with every line of body without line ending, iteration stops at the first error returned by fn
+func (r *Response) Lines(fn func(line []byte) error) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	if r.Response == nil || r.Response.Body == nil {
+		return nil
+	}
+	defer r.Response.Body.Close()
+	reader := bufio.NewReader(r.Response.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			if e := fn(line); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeStream decode json array or newline delimited json values from body one by one,
+// fn must like func(T) error or func(T), iteration stops at the first error returned by fn
+func (r *Response) DecodeStream(fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 1 || ft.NumOut() > 1 || (ft.NumOut() == 1 && ft.Out(0) != errorType) {
+		return fmt.Errorf("fn must like func(T) error, got %v", ft)
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	if r.Response == nil || r.Response.Body == nil {
+		return nil
+	}
+	defer r.Response.Body.Close()
+	reader := bufio.NewReader(r.Response.Body)
+	dec := json.NewDecoder(reader)
+	isArray, err := startsWithArray(reader)
+	if err != nil {
+		return err
+	}
+	if isArray {
+		/* consume [ */
+		if _, err = dec.Token(); err != nil {
+			return err
+		}
+	}
+	elemType := ft.In(0)
+	for {
+		if isArray && !dec.More() {
+			_, err = dec.Token()
+			return err
+		}
+		ptr := reflect.New(elemType)
+		if err = dec.Decode(ptr.Interface()); err == io.EOF && !isArray {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if out := fv.Call([]reflect.Value{ptr.Elem()}); len(out) == 1 && !out[0].IsNil() {
+			return out[0].Interface().(error)
+		}
+	}
+}
+
+func startsWithArray(reader *bufio.Reader) (bool, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return b[0] == '[', nil
+		}
+	}
+}
+
+// SSEEvent is a server-sent event
+type SSEEvent struct {
+	ID    string
+	Event string // "message" if not specified by server
+	Data  string
+	Retry time.Duration // zero if not specified by server
+}
+
+// Events parse body as text/event-stream, iteration stops at the first error returned by fn
+func (r *Response) Events(fn func(*SSEEvent) error) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	if r.Response == nil || r.Response.Body == nil {
+		return nil
+	}
+	defer r.Response.Body.Close()
+	return newSSEReader(r.Response.Body).Each(fn)
+}
+
+type SSEOption struct {
+	OnEvent       func(*SSEEvent) error // return error to stop subscription
+	LastEventID   string                // optional, resume after this event
+	ReconnectWait time.Duration         // optional, default 3s, server retry field takes precedence
+	MaxReconnect  int                   // optional, max consecutive reconnects without event, 0 means until ctx done, negative means never
+}
+
+// ErrSSEStatus is returned when event stream responds non 200 status, which should not be reconnected
+type ErrSSEStatus struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ErrSSEStatus) Error() string {
+	return fmt.Sprintf("event stream responds %s", e.Status)
+}
+
+// SSE subscribe server-sent events of uri, reconnect with Last-Event-ID when connection lost.
+// It returns nil when server responds 204, or the error returned by OnEvent, or ctx error
+func (client *clientImpl) SSE(ctx context.Context, uri string, opt SSEOption, opts ...Option) error {
+	if opt.OnEvent == nil {
+		return errors.New("sse: OnEvent is required")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	wait := opt.ReconnectWait
+	if wait <= 0 {
+		wait = 3 * time.Second
+	}
+	lastID := opt.LastEventID
+	var serverRetry time.Duration
+	opts = append(opts, WithStream(), WithHeaders(map[string]string{
+		"Accept":        "text/event-stream",
+		"Cache-Control": "no-cache",
+	}))
+	for failures := 0; ; {
+		reqOpts := opts
+		if lastID != "" {
+			reqOpts = append(reqOpts, WithHeader("Last-Event-ID", lastID))
+		}
+		res := client.Get(ctx, uri, reqOpts...)
+		if res.Err == nil {
+			if res.StatusCode == 204 {
+				res.Body.Close()
+				return nil
+			}
+			if res.StatusCode != 200 {
+				res.Body.Close()
+				return &ErrSSEStatus{StatusCode: res.StatusCode, Status: res.Status}
+			}
+			reader := newSSEReader(res.Body)
+			reader.lastID, reader.retry = lastID, serverRetry
+			err := reader.Each(func(ev *SSEEvent) error {
+				failures = 0
+				return opt.OnEvent(ev)
+			})
+			res.Body.Close()
+			lastID, serverRetry = reader.lastID, reader.retry
+			if serverRetry > 0 {
+				wait = serverRetry
+			}
+			/* stopped by OnEvent */
+			if err != nil && reader.stopped {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if opt.MaxReconnect < 0 || (opt.MaxReconnect > 0 && failures >= opt.MaxReconnect) {
+			if res.Err != nil {
+				return res.Err
+			}
+			return io.ErrUnexpectedEOF
+		}
+		failures++
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+type sseReader struct {
+	reader  *bufio.Reader
+	lastID  string
+	retry   time.Duration
+	stopped bool
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{reader: bufio.NewReader(r)}
+}
+
+// Each dispatch events until EOF, the last incomplete event is discarded
+func (sr *sseReader) Each(fn func(*SSEEvent) error) error {
+	var data strings.Builder
+	var event string
+	var hasData bool
+	for {
+		line, err := sr.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		/* blank line dispatch event */
+		if line == "" {
+			if hasData {
+				ev := &SSEEvent{ID: sr.lastID, Event: event, Data: strings.TrimSuffix(data.String(), "\n"), Retry: sr.retry}
+				if ev.Event == "" {
+					ev.Event = "message"
+				}
+				if err := fn(ev); err != nil {
+					sr.stopped = true
+					return err
+				}
+			}
+			data.Reset()
+			event, hasData = "", false
+			continue
+		}
+		/* comment */
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "event":
+			event = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				sr.lastID = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				sr.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// cancelOnClose release request context when stream body closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
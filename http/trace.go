@@ -0,0 +1,278 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	syshttp "net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportTiming is durations of an attempt, DNS, Connect and TLS are zero if connection reused
+type TransportTiming struct {
+	DNS      time.Duration
+	Connect  time.Duration
+	TLS      time.Duration
+	TTFB     time.Duration // from request written to first response byte
+	BodyRead time.Duration // from first response byte to body read or closed
+	Reused   bool
+}
+
+// SpanContext is W3C trace context
+type SpanContext struct {
+	TraceID    string // 32 hex chars
+	SpanID     string // 16 hex chars
+	Sampled    bool
+	TraceState string
+}
+
+// TraceParent format traceparent header
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent parse traceparent and tracestate headers of W3C trace context
+func ParseTraceParent(traceparent, tracestate string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	for _, p := range parts[:4] {
+		if !isHex(p) || strings.ToLower(p) != p {
+			return SpanContext{}, false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags[0]&1 == 1, TraceState: tracestate}, true
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext make requests with ctx children of sc
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Span is a client span of an attempt
+type Span struct {
+	Name         string
+	SpanContext  SpanContext
+	ParentSpanID string // empty for root span
+	Method       string
+	URL          string
+	StatusCode   int
+	Err          error
+	StartAt      time.Time
+	EndAt        time.Time
+	Timing       TransportTiming
+}
+
+type SpanExporter func(*Span)
+
+type TraceOption struct {
+	Exporter SpanExporter // optional, called when response body is read or closed, or request failed
+}
+
+// TraceMiddleware trace every attempt by httptrace, timing is set into TransportInfo and traceparent is propagated.
+// Parent is taken from ContextWithSpanContext, or traceparent header of request, otherwise a new trace starts.
+// Attempts of a call, like retries, are sibling spans of the same parent
+func TraceMiddleware(opt TraceOption) Middleware {
+	t := &tracer{opt: opt}
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			getValue(req).Tracer = t
+			return next(req)
+		}
+	}
+}
+
+type tracer struct {
+	opt TraceOption
+}
+
+func middlewareTrace(t *tracer) Middleware {
+	return func(next Endpoint) Endpoint {
+		return func(req *syshttp.Request) (*syshttp.Response, error) {
+			gv := getValue(req)
+			/* attempts of a call are siblings, header is cloned so caller's request never carries our span */
+			parent := *gv.TraceParent
+			span := &Span{
+				Name:         "HTTP " + req.Method,
+				SpanContext:  SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8), Sampled: parent.Sampled, TraceState: parent.TraceState},
+				ParentSpanID: parent.SpanID,
+				Method:       req.Method,
+				URL:          req.URL.String(),
+				StartAt:      time.Now(),
+			}
+			req = cloneRequestHeader(req)
+			req.Header.Set("traceparent", span.SpanContext.TraceParent())
+			if ts := span.SpanContext.TraceState; ts != "" {
+				req.Header.Set("tracestate", ts)
+			} else {
+				req.Header.Del("tracestate")
+			}
+
+			c := &traceCollector{}
+			gv.Timing = c
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), c.clientTrace()))
+			res, err := next(req)
+			finish := func() {
+				span.EndAt = time.Now()
+				span.Timing = c.snapshot()
+				if t.opt.Exporter != nil {
+					t.opt.Exporter(span)
+				}
+			}
+			if err != nil || res == nil || res.Body == nil {
+				span.Err = err
+				if res != nil {
+					span.StatusCode = res.StatusCode
+				}
+				finish()
+				return res, err
+			}
+			span.StatusCode = res.StatusCode
+			res.Body = &tracedBody{ReadCloser: res.Body, done: func() {
+				c.bodyDone()
+				finish()
+			}}
+			return res, err
+		}
+	}
+}
+
+// resolveTraceParent take parent from context, then traceparent header, otherwise start a new trace with empty parent span id
+func resolveTraceParent(req *syshttp.Request) SpanContext {
+	if parent, ok := SpanContextFromContext(req.Context()); ok {
+		return parent
+	}
+	if parent, ok := ParseTraceParent(req.Header.Get("traceparent"), req.Header.Get("tracestate")); ok {
+		return parent
+	}
+	return SpanContext{TraceID: randomHex(16), Sampled: true}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+type traceCollector struct {
+	mu                         sync.Mutex
+	wroteAt                    time.Time
+	dnsStart, connStart, tlsAt time.Time
+	firstByte                  time.Time
+	timing                     TransportTiming
+}
+
+func (c *traceCollector) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			c.mu.Lock()
+			c.dnsStart = time.Now()
+			c.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			c.mu.Lock()
+			c.timing.DNS = time.Since(c.dnsStart)
+			c.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			c.mu.Lock()
+			c.connStart = time.Now()
+			c.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			c.mu.Lock()
+			c.timing.Connect = time.Since(c.connStart)
+			c.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			c.mu.Lock()
+			c.tlsAt = time.Now()
+			c.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			c.mu.Lock()
+			c.timing.TLS = time.Since(c.tlsAt)
+			c.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			c.timing.Reused = info.Reused
+			c.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			c.mu.Lock()
+			c.wroteAt = time.Now()
+			c.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			c.mu.Lock()
+			c.firstByte = time.Now()
+			if !c.wroteAt.IsZero() {
+				c.timing.TTFB = c.firstByte.Sub(c.wroteAt)
+			}
+			c.mu.Unlock()
+		},
+	}
+}
+
+func (c *traceCollector) bodyDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.firstByte.IsZero() {
+		c.timing.BodyRead = time.Since(c.firstByte)
+	}
+}
+
+func (c *traceCollector) snapshot() TransportTiming {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timing
+}
+
+// tracedBody end span when body is read to the end or closed
+type tracedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}